@@ -12,6 +12,7 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 )
 
 var (
@@ -41,6 +42,8 @@ func init() {
 		fmt.Fprintf(w, "\n}\n")
 	})
 
+	http.Handle("/metrics", httpreplay.MetricsHandler())
+
 	http.HandleFunc("/debug/pprof/", httppptof.Index)
 	http.HandleFunc("/debug/pprof/cmdline", httppptof.Cmdline)
 	http.HandleFunc("/debug/pprof/profile", httppptof.Profile)
@@ -53,13 +56,24 @@ func main() {
 		runtime.GOMAXPROCS(runtime.NumCPU() * 2)
 	}
 
-	args := os.Args[1:]
-	var plugins *httpreplay.InOutPlugins
-	if len(args) > 0 {
-		flag.Parse()
-		httpreplay.CheckSettings()
-		plugins = httpreplay.NewPlugins()
+	flag.Parse()
+	if err := httpreplay.LoadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := httpreplay.CheckSettings(); err != nil {
+		log.Fatal(err)
+	}
+	if httpreplay.Settings.PrintConfig {
+		httpreplay.PrintConfig(os.Stdout)
+		return
 	}
+	if httpreplay.Settings.Pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(httpreplay.Settings.Pprof, nil))
+		}()
+	}
+
+	plugins := httpreplay.NewPlugins()
 	log.Printf("[PPID %d and PID %d] \n", os.Getppid(), os.Getpid())
 
 	if len(plugins.Inputs) == 0 || len(plugins.Outputs) == 0 {
@@ -70,15 +84,48 @@ func main() {
 	emitter := httpreplay.NewEmitter()
 	go emitter.Start(plugins)
 
+	if httpreplay.Settings.ExitAfter > 0 {
+		log.Printf("Running httpcopy for a duration of %s\n", httpreplay.Settings.ExitAfter)
+		time.AfterFunc(httpreplay.Settings.ExitAfter, func() {
+			log.Printf("httpcopy run timeout %s\n", httpreplay.Settings.ExitAfter)
+			close(closeCh)
+		})
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	exit := 0
+loop:
+	for {
+		select {
+		case <-c:
+			exit = 1
+			break loop
+		case <-closeCh:
+			exit = 0
+			break loop
+		case <-hup:
+			if err := httpreplay.ReloadConfig(); err != nil {
+				log.Printf("[RELOAD] keeping previous configuration: %s", err)
+				continue
+			}
+			emitter.Reload()
+			log.Printf("[RELOAD] configuration reloaded")
+		}
+	}
+	// a second signal skips waiting for outputs to drain
+	closed := make(chan struct{})
+	go func() {
+		emitter.Close()
+		close(closed)
+	}()
 	select {
+	case <-closed:
 	case <-c:
+		log.Printf("Exiting without waiting for outputs to drain")
 		exit = 1
-	case <-closeCh:
-		exit = 0
 	}
-	emitter.Close()
 	os.Exit(exit)
 }
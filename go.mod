@@ -1,3 +1,5 @@
 module httpcopy
 
-go 1.18
+go 1.24
+
+require gopkg.in/yaml.v3 v3.0.1
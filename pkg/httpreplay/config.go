@@ -0,0 +1,189 @@
+package httpreplay
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables overriding settings, e.g. HTTPCOPY_OUTPUT_HTTP_WORKERS
+const EnvPrefix = "HTTPCOPY_"
+
+// defaultSettings are settings before flags are parsed
+var defaultSettings AppSettings
+
+// LoadConfig applies settings from --config file and HTTPCOPY_* environment variables to flags which
+// were not given on the command line. Keys of the file and names of the variables are flag names,
+// so precedence is: defaults, config file, environment, command line.
+// Must be called after flag.Parse.
+func LoadConfig() error {
+	return loadConfig(flag.CommandLine, Settings.Config, os.Environ())
+}
+
+func loadConfig(flags *flag.FlagSet, path string, environ []string) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix) {
+			env[k] = v
+		}
+	}
+
+	if v, ok := env[envName("config")]; ok && !explicit["config"] {
+		path = v
+	}
+
+	file := make(map[string]interface{})
+	if path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return err
+		}
+		for name := range file {
+			if flags.Lookup(name) == nil {
+				return fmt.Errorf("unknown setting %q in %s", name, path)
+			}
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		if v, ok := env[envName(f.Name)]; ok {
+			if err = setFlag(f, envValue(v)); err != nil {
+				err = fmt.Errorf("invalid %s: %v", envName(f.Name), err)
+			}
+			return
+		}
+		if v, ok := file[f.Name]; ok {
+			if err = setFlag(f, v); err != nil {
+				err = fmt.Errorf("invalid %q in %s: %v", f.Name, path, err)
+			}
+		}
+	})
+	return err
+}
+
+// settingsMu guards Settings replaced by ReloadConfig against readers in other goroutines, e.g. Debug
+var settingsMu sync.RWMutex
+
+// ReloadConfig builds Settings again from defaults, --config file, environment and command line.
+// Settings are parsed aside and replaced at once, previous settings are kept if the new ones are invalid.
+func ReloadConfig() error {
+	return reloadConfig(os.Args[1:])
+}
+
+func reloadConfig(args []string) error {
+	var settings AppSettings
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	// parse error is returned to be logged, without usage
+	flags.SetOutput(io.Discard)
+	registerFlags(flags, &settings)
+
+	err := flags.Parse(args)
+	if err == nil {
+		err = loadConfig(flags, settings.Config, os.Environ())
+	}
+	if err == nil {
+		err = checkSettings(&settings)
+	}
+	if err != nil {
+		return err
+	}
+	settingsMu.Lock()
+	Settings = settings
+	settingsMu.Unlock()
+	return nil
+}
+
+// envName returns name of the environment variable for flag, e.g. HTTPCOPY_OUTPUT_HTTP for output-http
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// envValue decodes JSON array, so flags accepting multiple values can be set from one variable:
+// HTTPCOPY_OUTPUT_HTTP='["http://staging-1", "http://staging-2"]'
+func envValue(v string) interface{} {
+	var list []interface{}
+	if strings.HasPrefix(v, "[") && json.Unmarshal([]byte(v), &list) == nil {
+		return list
+	}
+	return v
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &config)
+	default:
+		err = yaml.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// setFlag sets value from config, lists are set item by item like repeated flags
+func setFlag(f *flag.Flag, value interface{}) error {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, v := range value {
+			if err := setFlag(f, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		return fmt.Errorf("expected value or list of values")
+	case nil:
+		return nil
+	}
+	return f.Value.Set(fmt.Sprint(value))
+}
+
+// PrintConfig writes effective settings as JSON, in the format accepted by --config
+func PrintConfig(w io.Writer) error {
+	return printConfig(w, flag.CommandLine)
+}
+
+func printConfig(w io.Writer, flags *flag.FlagSet) error {
+	config := make(map[string]interface{})
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		var value interface{} = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		config[f.Name] = value
+	})
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(config)
+}
@@ -0,0 +1,149 @@
+package httpreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testConfigFlags() (*flag.FlagSet, *AppSettings) {
+	settings := new(AppSettings)
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.StringVar(&settings.Config, "config", "", "")
+	flags.Var(&MultiOption{&settings.OutputHTTP}, "output-http", "")
+	flags.IntVar(&settings.OutputHTTPConfig.WorkersMax, "output-http-workers", 0, "")
+	flags.DurationVar(&settings.OutputHTTPConfig.Timeout, "output-http-timeout", time.Second, "")
+	flags.BoolVar(&settings.OutputHTTPConfig.TrackResponses, "output-http-track-response", false, "")
+	flags.Var(&settings.ModifierConfig.Headers, "http-set-header", "")
+	return flags, settings
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`
+output-http:
+  - http://staging-1
+  - http://staging-2
+output-http-workers: 10
+output-http-timeout: 5s
+output-http-track-response: true
+http-set-header: "X-Env: staging"
+`), 0600)
+
+	flags, settings := testConfigFlags()
+	flags.Parse([]string{"--output-http-workers", "20"})
+	environ := []string{"HTTPCOPY_OUTPUT_HTTP_TIMEOUT=30s", "OUTPUT_HTTP_TIMEOUT=1m"}
+	if err := loadConfig(flags, path, environ); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(settings.OutputHTTP, []string{"http://staging-1", "http://staging-2"}) {
+		t.Error("Expected outputs from config file, got", settings.OutputHTTP)
+	}
+	if settings.OutputHTTPConfig.WorkersMax != 20 {
+		t.Error("Flags should override config file, got", settings.OutputHTTPConfig.WorkersMax)
+	}
+	if settings.OutputHTTPConfig.Timeout != 30*time.Second {
+		t.Error("Environment should override config file, got", settings.OutputHTTPConfig.Timeout)
+	}
+	if !settings.OutputHTTPConfig.TrackResponses || len(settings.ModifierConfig.Headers) != 1 {
+		t.Errorf("Expected values from config file, got %+v", settings)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"unknown.json": `{"output-http-worker": 10}`,
+		"invalid.json": `{"output-http-workers": "many"}`,
+		"nested.yaml":  "output-http:\n  url: http://staging\n",
+		"syntax.yaml":  "output-http: [",
+	}
+	for name, content := range tests {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0600)
+		flags, _ := testConfigFlags()
+		if err := loadConfig(flags, path, nil); err == nil {
+			t.Errorf("Expected error for %s", name)
+		}
+	}
+
+	flags, _ := testConfigFlags()
+	if err := loadConfig(flags, "", []string{"HTTPCOPY_OUTPUT_HTTP_WORKERS=many"}); err == nil {
+		t.Error("Expected error for invalid environment variable")
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	flags, settings := testConfigFlags()
+	flags.Parse([]string{"--http-set-header", "X-Env: staging", "--output-http-timeout", "5s"})
+	environ := []string{`HTTPCOPY_OUTPUT_HTTP=["http://staging-1","http://staging-2"]`}
+	if err := loadConfig(flags, "", environ); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	printConfig(&buf, flags)
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, buf.Bytes(), 0600)
+
+	// printed config can be loaded back
+	flags2, settings2 := testConfigFlags()
+	if err := loadConfig(flags2, path, nil); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if !reflect.DeepEqual(settings, settings2) {
+		t.Errorf("Expected %+v, got %+v", settings, settings2)
+	}
+
+	var printed map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &printed)
+	if printed["output-http-timeout"] != "5s" || !reflect.DeepEqual(printed["http-set-header"], []interface{}{"X-Env: staging"}) {
+		t.Error("Unexpected config:", buf.String())
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer func(settings AppSettings) { Settings = settings }(Settings)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("HTTPCOPY_CONFIG", path)
+
+	os.WriteFile(path, []byte(`{"output-http": ["http://staging"], "output-http-workers": 5}`), 0600)
+	if err := reloadConfig(nil); err != nil {
+		t.Fatal(err)
+	}
+	if Settings.OutputHTTPConfig.WorkersMax != 5 || !reflect.DeepEqual(Settings.OutputHTTP, []string{"http://staging"}) {
+		t.Errorf("Expected settings from config, got %+v", Settings)
+	}
+
+	os.WriteFile(path, []byte(`{"output-http": ["http://canary"], "output-http-workers": 5, "output-http-workers-min": 10}`), 0600)
+	if err := reloadConfig(nil); err == nil {
+		t.Error("Expected error for invalid config")
+	}
+	if !reflect.DeepEqual(Settings.OutputHTTP, []string{"http://staging"}) {
+		t.Error("Previous settings should be kept, got", Settings.OutputHTTP)
+	}
+
+	// settings are read by other goroutines while they are reloaded
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			Debug(10, "reloading")
+		}
+	}()
+	if err := reloadConfig([]string{"--verbose", "1"}); err == nil {
+		t.Error("Expected error for invalid config")
+	}
+	os.WriteFile(path, []byte(`{"output-http": ["http://canary"]}`), 0600)
+	if err := reloadConfig([]string{"--verbose", "1"}); err != nil || Settings.Verbose != 1 {
+		t.Errorf("Expected flags to override config, got %v %d", err, Settings.Verbose)
+	}
+	<-done
+}
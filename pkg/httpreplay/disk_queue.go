@@ -0,0 +1,134 @@
+package httpreplay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// diskQueue is a FIFO of messages stored in a temporary file using the same format as FileOutput.
+// It is used to hold messages which do not fit into an in-memory queue.
+type diskQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	writer  *os.File
+	file    *os.File
+	reader  *bufio.Reader
+	pending int
+	popped  int // messages returned by Pop which are not Done yet
+	closed  bool
+}
+
+func newDiskQueue(dir string) (*diskQueue, error) {
+	writer, err := ioutil.TempFile(dir, "httpcopy-spill-*.gor")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(writer.Name())
+	if err != nil {
+		writer.Close()
+		os.Remove(writer.Name())
+		return nil, err
+	}
+
+	q := &diskQueue{writer: writer, file: file, reader: bufio.NewReader(file)}
+	q.cond = sync.NewCond(&q.mu)
+	return q, nil
+}
+
+// Push appends message to the end of the queue
+func (q *diskQueue) Push(msg *Message) error {
+	var buf bytes.Buffer
+	buf.Grow(len(msg.Meta) + len(msg.Data) + len(PayloadSeparator))
+	buf.Write(msg.Meta)
+	buf.Write(msg.Data)
+	buf.WriteString(PayloadSeparator)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrorStopped
+	}
+	if _, err := q.writer.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	q.pending++
+	q.cond.Signal()
+	return nil
+}
+
+// Pop waits for the next message, it returns ErrorStopped once the queue is closed.
+// The message is counted by Len until Done is called.
+func (q *diskQueue) Pop() (*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.pending == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, ErrorStopped
+	}
+
+	separator := []byte(PayloadSeparator)
+	var record bytes.Buffer
+	for {
+		line, err := q.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if bytes.Equal(separator[1:], line) {
+			break
+		}
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		record.Write(line)
+	}
+
+	q.pending--
+	q.popped++
+	if q.pending == 0 {
+		// everything was consumed, start over to keep the file small
+		q.writer.Truncate(0)
+		q.writer.Seek(0, io.SeekStart)
+		q.file.Seek(0, io.SeekStart)
+		q.reader.Reset(q.file)
+	}
+
+	data := record.Bytes()
+	var msg Message
+	msg.Meta, msg.Data = PayloadMetaWithBody(data[:len(data)-1])
+	return &msg, nil
+}
+
+// Done tells that message returned by Pop was handed over
+func (q *diskQueue) Done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.popped--
+}
+
+// Len returns number of messages waiting in the queue, including popped ones which are not Done
+func (q *diskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending + q.popped
+}
+
+// Close releases waiting readers and removes the backing file
+func (q *diskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	q.file.Close()
+	q.writer.Close()
+	return os.Remove(q.writer.Name())
+}
@@ -1,54 +1,332 @@
 package httpreplay
 
 import (
+	"expvar"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"httpcopy/pkg/size"
 )
 
 // Emitter represents an abject to manage plugins communication
 type Emitter struct {
 	sync.WaitGroup
-	plugins *InOutPlugins
+	inputs     sync.WaitGroup // copy goroutines reading from inputs, not from outputs
+	mu         sync.Mutex
+	plugins    *InOutPlugins
+	pipeline   atomic.Value // *pipeline
+	middleware *Middleware
+	copying    map[interface{}]bool // readers with running copy goroutine, by plugin without limiter
+	retiring   sync.WaitGroup       // outputs removed by Reload which are still sending queued messages
+	stopStats  chan struct{}
+}
+
+// pipeline holds outputs and everything messages pass through on the way to them.
+// It is replaced as a whole on reload, while copy goroutines keep running.
+type pipeline struct {
+	outputs        []PluginWriter
+	outputStats    []*expvar.Map
+	router         *outputRouter
+	modifier       *HTTPModifier
+	copyBufferSize size.Size
+}
+
+// newPipeline creates pipeline to outputs configured by Settings
+func newPipeline(outputs []PluginWriter) *pipeline {
+	// modifier keeps the config, so it must not change on reload
+	modifierConfig := Settings.ModifierConfig
+	stats := make([]*expvar.Map, len(outputs))
+	for i, out := range outputs {
+		stats[i] = pluginStats(out)
+	}
+	return &pipeline{
+		outputs:        outputs,
+		outputStats:    stats,
+		router:         splitRouter(outputs),
+		modifier:       NewHTTPModifier(&modifierConfig),
+		copyBufferSize: Settings.CopyBufferSize,
+	}
 }
 
 // NewEmitter creates and initializes new Emitter object.
 func NewEmitter() *Emitter {
-	return &Emitter{}
+	return &Emitter{copying: make(map[interface{}]bool)}
 }
 
 // Start initialize loop for sending data from inputs to outputs
 func (e *Emitter) Start(plugins *InOutPlugins) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	e.plugins = plugins
+	// pipeline is shared, so responses read from outputs follow their requests
+	e.pipeline.Store(newPipeline(plugins.Outputs))
+
+	if Settings.Stats {
+		e.stopStats = make(chan struct{})
+		go reportPluginStats(e.stopStats)
+	}
+
+	if Settings.Middleware != "" {
+		e.middleware = NewMiddleware(Settings.Middleware)
+
+		for _, in := range plugins.Inputs {
+			e.middleware.ReadFrom(in)
+			e.copying[unwrapLimiter(in)] = true
+		}
+
+		e.plugins.Inputs = append(e.plugins.Inputs, e.middleware)
+		e.plugins.All = append(e.plugins.All, e.middleware)
+		e.copy(e.middleware)
+		return
+	}
 
 	for _, in := range plugins.Inputs {
-		e.Add(1)
-		go func(in PluginReader) {
-			defer e.Done()
-			if err := CopyMulty(in, plugins.Outputs...); err != nil {
-				fmt.Println(2, fmt.Sprintf("[EMITTER] error during copy: %q", err))
+		e.copy(in)
+	}
+}
+
+func (e *Emitter) copy(in PluginReader) {
+	e.copying[unwrapLimiter(in)] = true
+	input := !isOutput(in)
+	e.Add(1)
+	if input {
+		e.inputs.Add(1)
+	}
+	go func() {
+		defer e.Done()
+		if input {
+			defer e.inputs.Done()
+		}
+		if err := copyMulty(in, e.currentPipeline); err != nil {
+			fmt.Println(2, fmt.Sprintf("[EMITTER] error during copy: %q", err))
+		}
+	}()
+}
+
+func (e *Emitter) currentPipeline() *pipeline {
+	return e.pipeline.Load().(*pipeline)
+}
+
+// Reload switches traffic to outputs, limiters, filters and rewrite rules configured in Settings.
+// Inputs keep running, outputs which didn't change are kept and reopened,
+// removed outputs get Settings.DrainTimeout to send queued messages and are closed in background.
+func (e *Emitter) Reload() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	previous := e.plugins
+	if previous == nil {
+		// not started yet
+		return
+	}
+	plugins := newPlugins(previous)
+
+	e.plugins = plugins
+	e.pipeline.Store(newPipeline(plugins.Outputs))
+
+	for _, in := range plugins.Inputs {
+		if e.copying[unwrapLimiter(in)] {
+			continue
+		}
+		if e.middleware != nil {
+			e.copying[unwrapLimiter(in)] = true
+			e.middleware.ReadFrom(in)
+			continue
+		}
+		e.copy(in)
+	}
+
+	kept := make(map[interface{}]bool)
+	for _, p := range plugins.All {
+		kept[unwrapLimiter(p)] = true
+	}
+	var removed []interface{}
+	for _, p := range previous.All {
+		p = unwrapLimiter(p)
+		if kept[p] {
+			if r, ok := p.(reopener); ok {
+				r.Reopen()
 			}
-		}(in)
+			continue
+		}
+		removed = append(removed, p)
+		delete(e.copying, p)
 	}
+
+	deadline := time.Now().Add(Settings.DrainTimeout)
+	e.retiring.Add(1)
+	go func() {
+		defer e.retiring.Done()
+		for _, p := range removed {
+			if d, ok := p.(drainer); ok {
+				if pending := d.Drain(deadline); pending > 0 {
+					Debug(0, fmt.Sprintf("[EMITTER] %s: %d messages still pending after --drain-timeout", p, pending))
+				}
+			}
+		}
+		for _, p := range removed {
+			Debug(1, fmt.Sprintf("[EMITTER] closing %s", p))
+			if cp, ok := p.(io.Closer); ok {
+				cp.Close()
+			}
+		}
+	}()
+}
+
+// reopener is implemented by outputs which reopen their files on reload, e.g. after log rotation
+type reopener interface {
+	Reopen() error
+}
+
+// drainer is implemented by outputs which queue messages, so that shutdown can wait until they are sent
+type drainer interface {
+	Drain(deadline time.Time) (pending int)
+}
+
+// summarizer is implemented by plugins which count delivered, failed or dropped messages
+type summarizer interface {
+	Summary() map[string]int64
 }
 
-// Close closes all the goroutine and waits for it to finish.
+// Close shuts plugins down in order, so that messages already read are not lost: inputs are closed
+// first and messages they queued are copied to outputs, outputs get Settings.DrainTimeout to send
+// queued messages, then outputs are closed and counters of every plugin are reported.
 func (e *Emitter) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopStats != nil {
+		close(e.stopStats)
+		e.stopStats = nil
+	}
+	if e.plugins == nil || len(e.plugins.All) == 0 {
+		return
+	}
+	deadline := time.Now().Add(Settings.DrainTimeout)
+
+	var inputs, readers, writers []interface{}
 	for _, p := range e.plugins.All {
-		if cp, ok := p.(io.Closer); ok {
-			cp.Close()
+		switch {
+		case p == interface{}(e.middleware):
+			// closed once it passed on messages of the inputs
+		case !isOutput(p):
+			inputs = append(inputs, p)
+		case isReader(p):
+			readers = append(readers, p)
+		default:
+			writers = append(writers, p)
 		}
 	}
-	if len(e.plugins.All) > 0 {
-		// wait for everything to stop
-		e.Wait()
+
+	closePlugins(inputs)
+	if e.middleware != nil && !e.middleware.CloseInput(deadline) {
+		Debug(0, "[EMITTER] middleware didn't get messages of inputs before --drain-timeout")
+	}
+	if !waitUntil(&e.inputs, deadline) {
+		Debug(0, "[EMITTER] inputs didn't stop before --drain-timeout")
+	}
+	if e.middleware != nil {
+		e.middleware.Close()
+	}
+
+	for _, p := range e.plugins.Outputs {
+		if d, ok := unwrapLimiter(p).(drainer); ok {
+			if pending := d.Drain(deadline); pending > 0 {
+				Debug(0, fmt.Sprintf("[EMITTER] %s: %d messages still pending after --drain-timeout", p, pending))
+			}
+		}
+	}
+	if !waitUntil(&e.retiring, deadline) {
+		Debug(0, "[EMITTER] outputs removed by reload didn't stop before --drain-timeout")
+	}
+
+	// responses read from outputs are written to other outputs, so those are closed last
+	closePlugins(readers)
+	e.Wait()
+	closePlugins(writers)
+
+	for _, p := range e.plugins.All {
+		reportShutdown(p)
 	}
 	e.plugins.All = nil // avoid Close to make changes again
 }
 
+func closePlugins(plugins []interface{}) {
+	for _, p := range plugins {
+		if cp, ok := p.(io.Closer); ok {
+			if err := cp.Close(); err != nil {
+				Debug(1, fmt.Sprintf("[EMITTER] closing %s: %q", p, err))
+			}
+		}
+	}
+}
+
+func isReader(plugin interface{}) bool {
+	_, ok := unwrapLimiter(plugin).(PluginReader)
+	return ok
+}
+
+// waitUntil waits for wg and reports whether it finished before deadline
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// reportShutdown prints how many messages plugin has read and written, and its own counters,
+// e.g. "HTTP output: http://staging: written 100, delivered 97, dropped 0, failed 1, pending 2"
+func reportShutdown(plugin interface{}) {
+	stats := pluginStats(plugin)
+	var counters []string
+	for _, direction := range []string{"read", "written"} {
+		if count := expvarInt(stats, direction); count > 0 {
+			counters = append(counters, fmt.Sprintf("%s %d", direction, count))
+		}
+	}
+	if s, ok := unwrapLimiter(plugin).(summarizer); ok {
+		summary := s.Summary()
+		keys := make([]string, 0, len(summary))
+		for k := range summary {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			counters = append(counters, fmt.Sprintf("%s %d", k, summary[k]))
+		}
+	}
+	if len(counters) > 0 {
+		Debug(0, fmt.Sprintf("[EMITTER] %s: %s", plugin, strings.Join(counters, ", ")))
+	}
+}
+
 // CopyMulty copies from 1 reader to multiple writers
 func CopyMulty(src PluginReader, writers ...PluginWriter) error {
-	//wIndex := 0
+	p := newPipeline(writers)
+	return copyMulty(src, func() *pipeline { return p })
+}
+
+// copyMulty copies messages from reader to all outputs of the current pipeline, or to one of them picked by router
+func copyMulty(src PluginReader, current func() *pipeline) error {
+	srcStats := pluginStats(src)
+	filteredRequests := make(map[string]int64)
+	filteredRequestsLastCleanTime := time.Now().UnixNano()
+	filteredCount := 0
+
 	for {
 		msg, err := src.PluginRead()
 		if err != nil {
@@ -58,20 +336,77 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 			return err
 		}
 		if msg != nil && len(msg.Data) > 0 {
-			//if len(msg.Data) > int(Settings.CopyBufferSize) {
-			//	msg.Data = msg.Data[:Settings.CopyBufferSize]
-			//}
+			p := current()
+			countMessage(srcStats, "read", msg)
 			meta := PayloadMeta(msg.Meta)
 			if len(meta) < 3 {
 				fmt.Println(2, fmt.Sprintf("[EMITTER] Found malformed record %q from %q", msg.Meta, src))
 				continue
 			}
+			// payloads truncated by the input were capped already, WebSocket frames are useless once cut
+			if _, truncated := PayloadMetaField(msg.Meta, "truncated"); p.copyBufferSize > 0 && len(msg.Data) > int(p.copyBufferSize) &&
+				!truncated && !IsWebSocketPayload(msg.Meta) {
+				msg.Data = truncatePayload(msg.Data, int(p.copyBufferSize))
+				msg.Meta = PayloadMetaAppend(msg.Meta, MetaField("truncated", "1"))
+			}
+
+			if p.modifier != nil {
+				requestID := string(meta[1])
+				if IsRequestPayload(msg.Meta) {
+					msg.Data = p.modifier.Rewrite(msg.Data)
+					// If modifier tells to skip request
+					if len(msg.Data) == 0 {
+						filteredRequests[requestID] = time.Now().UnixNano()
+						filteredCount++
+						continue
+					}
+				} else if _, ok := filteredRequests[requestID]; ok {
+					// responses of filtered requests are dropped as well
+					if IsWebSocketPayload(msg.Meta) {
+						// so are all frames of filtered WebSocket sessions
+						filteredRequests[requestID] = time.Now().UnixNano()
+					} else {
+						delete(filteredRequests, requestID)
+						filteredCount--
+					}
+					continue
+				}
+			}
+
+			writers, stats := p.outputs, p.outputStats
+			if p.router != nil {
+				i := p.router.Route(msg)
+				writers, stats = writers[i:i+1], stats[i:i+1]
+			}
 
-			for _, dst := range writers {
-				if _, err := dst.PluginWrite(msg); err != nil && err != io.ErrClosedPipe {
+			for i, dst := range writers {
+				_, err := dst.PluginWrite(msg)
+				if err == nil {
+					countMessage(stats[i], "written", msg)
+				}
+				if err != nil && err != io.ErrClosedPipe {
+					// output was removed by reload while we were writing to it
+					if current() != p {
+						continue
+					}
 					return err
 				}
 			}
 		}
+
+		// Run GC on each 1000 request
+		if filteredCount > 0 && filteredCount%1000 == 0 {
+			// Clean up filtered requests for which we didn't get a response to filter
+			now := time.Now().UnixNano()
+			if now-filteredRequestsLastCleanTime > int64(60*time.Second) {
+				for k, v := range filteredRequests {
+					if now-v > int64(60*time.Second) {
+						delete(filteredRequests, k)
+						filteredCount--
+					}
+				}
+				filteredRequestsLastCleanTime = time.Now().UnixNano()
+			}
+		}
 	}
 }
@@ -0,0 +1,365 @@
+package httpreplay
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"httpcopy/pkg/size"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEmitterSplitRoundRobin(t *testing.T) {
+	defer func(split bool) { Settings.SplitOutput = split }(Settings.SplitOutput)
+	Settings.SplitOutput = true
+
+	wg := new(sync.WaitGroup)
+	input := NewTestInput()
+
+	var counters [2]int
+	var mu sync.Mutex
+	output1 := NewTestOutput(func(*Message) { mu.Lock(); counters[0]++; mu.Unlock(); wg.Done() })
+	output2 := NewTestOutput(func(*Message) { mu.Lock(); counters[1]++; mu.Unlock(); wg.Done() })
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output1, output2},
+	}
+	plugins.All = append(plugins.All, input, output1, output2)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+	wg.Wait()
+	emitter.Close()
+
+	if counters[0] != 500 || counters[1] != 500 {
+		t.Errorf("Round robin should split traffic equally: %v", counters)
+	}
+}
+
+func TestEmitterSplitSessionKey(t *testing.T) {
+	defer func(split bool, key string) { Settings.SplitOutput, Settings.SplitOutputKey = split, key }(Settings.SplitOutput, Settings.SplitOutputKey)
+	Settings.SplitOutput = true
+	Settings.SplitOutputKey = "header:Authorization"
+
+	wg := new(sync.WaitGroup)
+	input := NewTestInput()
+	input.skipHeader = true
+
+	var mu sync.Mutex
+	outputs := make(map[string]map[int]bool) // session -> outputs which received it
+	responses := make(map[string]int)        // request id -> output
+	var plugins InOutPlugins
+	plugins.Inputs = []PluginReader{input}
+	for i := 0; i < 3; i++ {
+		i := i
+		plugins.Outputs = append(plugins.Outputs, NewTestOutput(func(msg *Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			id := string(PayloadID(msg.Meta))
+			if IsRequestPayload(msg.Meta) {
+				session := string(msg.Data)
+				if outputs[session] == nil {
+					outputs[session] = make(map[int]bool)
+				}
+				outputs[session][i] = true
+				responses[id] = i
+			} else if responses[id] != i {
+				t.Errorf("Response %s should follow its request to output %d, got %d", id, responses[id], i)
+			}
+			wg.Done()
+		}))
+	}
+	plugins.All = append(plugins.All, input)
+
+	emitter := NewEmitter()
+	go emitter.Start(&plugins)
+
+	for i := 0; i < 300; i++ {
+		wg.Add(2)
+		id := fmt.Sprintf("%024d", i)
+		input.EmitBytes([]byte(fmt.Sprintf("1 %s 1 -1\nGET / HTTP/1.1\r\nAuthorization: user%d\r\n\r\n", id, i%10)))
+		input.EmitBytes([]byte(fmt.Sprintf("2 %s 1 1\nHTTP/1.1 200 OK\r\n\r\n", id)))
+	}
+	wg.Wait()
+	emitter.Close()
+
+	used := make(map[int]bool)
+	for session, received := range outputs {
+		if len(received) != 1 {
+			t.Errorf("Session %q should be sent to a single output, got %v", session, received)
+		}
+		for i := range received {
+			used[i] = true
+		}
+	}
+	if len(outputs) != 10 || len(used) < 2 {
+		t.Errorf("Sessions should be spread among outputs: %v", outputs)
+	}
+}
+
+func TestEmitterReload(t *testing.T) {
+	defer func(settings AppSettings) { Settings = settings }(Settings)
+
+	received := make(chan string, 10)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- name + " " + r.URL.Path + " " + r.Header.Get("X-Env")
+		}))
+	}
+	staging, canary := newServer("staging"), newServer("canary")
+	defer staging.Close()
+	defer canary.Close()
+
+	Settings = defaultSettings
+	Settings.OutputHTTP = []string{staging.URL}
+	Settings.OutputFile = []string{filepath.Join(t.TempDir(), "requests.gor")}
+	Settings.OutputFileConfig.Append = true
+
+	input := NewTestInput()
+	plugins := NewPlugins()
+	plugins.Inputs = append(plugins.Inputs, input)
+	plugins.All = append(plugins.All, input)
+	fileOutput := plugins.Outputs[0]
+
+	emitter := NewEmitter()
+	emitter.Start(plugins)
+	defer emitter.Close()
+
+	input.EmitGET()
+	if r := <-received; r != "staging / " {
+		t.Errorf("Expected request to staging, got %q", r)
+	}
+
+	Settings.OutputHTTP = []string{canary.URL + "|100%"}
+	Settings.ModifierConfig.Headers.Set("X-Env: canary")
+	emitter.Reload()
+
+	input.EmitGET()
+	if r := <-received; r != "canary / canary" {
+		t.Errorf("Expected rewritten request to canary, got %q", r)
+	}
+
+	if len(emitter.plugins.Outputs) != 2 || emitter.plugins.Outputs[0] != fileOutput {
+		t.Error("Unchanged output should be kept:", emitter.plugins.Outputs)
+	}
+	if len(emitter.plugins.Inputs) == 0 || emitter.plugins.Inputs[len(emitter.plugins.Inputs)-1] != input {
+		t.Error("Inputs should be kept:", emitter.plugins.Inputs)
+	}
+}
+
+func TestEmitterReloadInputLimit(t *testing.T) {
+	defer func(settings AppSettings) { Settings = settings }(Settings)
+
+	Settings = defaultSettings
+	Settings.InputHTTP = []string{"127.0.0.1:0|10"}
+	plugins := NewPlugins()
+	limiter := plugins.Inputs[0].(*Limiter)
+	defer limiter.Close()
+
+	Settings.InputHTTP = []string{"127.0.0.1:0|50%"}
+	plugins = newPlugins(plugins)
+	if plugins.Inputs[0] != limiter || limiter.limit != 50 || !limiter.isPercent {
+		t.Errorf("Limit of kept input should be changed: %s", plugins.Inputs[0])
+	}
+
+	Settings.InputHTTP = []string{"127.0.0.1:0"}
+	newPlugins(plugins)
+	for i := 0; i < 100; i++ {
+		if limiter.isLimited() {
+			t.Fatal("Removed limit should let all messages through")
+		}
+	}
+}
+
+func TestEmitterReloadDrainsRemovedOutputs(t *testing.T) {
+	defer func(settings AppSettings) { Settings = settings }(Settings)
+
+	release := make(chan struct{})
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt64(&received, 1)
+	}))
+	defer server.Close()
+
+	Settings = defaultSettings
+	Settings.OutputHTTP = []string{server.URL}
+	Settings.OutputHTTPConfig.WorkersMax = 1
+	Settings.OutputHTTPConfig.QueueLen = 2
+
+	input := NewTestInput()
+	plugins := NewPlugins()
+	plugins.Inputs = append(plugins.Inputs, input)
+	plugins.All = append(plugins.All, input)
+	output := unwrapLimiter(plugins.Outputs[0]).(*HTTPOutput)
+
+	emitter := NewEmitter()
+	emitter.Start(plugins)
+
+	// one request is being sent and two fill the queue
+	for i := 0; i < 3; i++ {
+		input.EmitGET()
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(output.queue) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	before := output.Summary()
+
+	Settings.OutputHTTPConfig.Timeout = 10 * time.Second
+	emitter.Reload()
+	if emitter.plugins.Outputs[0] == plugins.Outputs[0] {
+		t.Fatal("Output with changed options should be replaced")
+	}
+	close(release)
+	emitter.Close()
+
+	summary := output.Summary()
+	if summary["dropped"]-before["dropped"] != 0 || summary["delivered"]-before["delivered"] != 3 || atomic.LoadInt64(&received) != 3 {
+		t.Errorf("Queued requests of the replaced output should be sent, got %d: %v", received, summary)
+	}
+}
+
+func TestEmitterPluginStats(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	input := NewTestInput()
+	output := NewTestOutput(func(*Message) { wg.Done() })
+	before := expvarInt(pluginStats(output), "written")
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+	wg.Wait()
+	emitter.Close()
+
+	stats := expvar.Get("plugins").(*expvar.Map).Get(fmt.Sprint(output)).(*expvar.Map)
+	if written := expvarInt(stats, "written") - before; written != 10 {
+		t.Errorf("Expected 10 written messages, got %d", written)
+	}
+	if expvarInt(stats, "written_bytes") == 0 || expvarInt(pluginStats(input), "read") == 0 {
+		t.Errorf("Expected bytes and reads to be counted: %s", expvar.Get("plugins"))
+	}
+}
+
+func TestEmitterCloseDrainsOutputs(t *testing.T) {
+	defer func(timeout time.Duration) { Settings.DrainTimeout = timeout }(Settings.DrainTimeout)
+
+	for _, tt := range []struct {
+		drainTimeout time.Duration
+		drained      bool
+	}{
+		{10 * time.Second, true},
+		{20 * time.Millisecond, false},
+	} {
+		Settings.DrainTimeout = tt.drainTimeout
+
+		var received int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt64(&received, 1)
+		}))
+
+		input := NewTestInput()
+		output := NewHTTPOutput(server.URL, &HTTPOutputConfig{WorkersMax: 1}).(*HTTPOutput)
+		before := output.Summary()
+
+		plugins := &InOutPlugins{
+			Inputs:  []PluginReader{input},
+			Outputs: []PluginWriter{output},
+		}
+		plugins.All = append(plugins.All, input, output)
+
+		emitter := NewEmitter()
+		emitter.Start(plugins)
+		for i := 0; i < 20; i++ {
+			input.EmitGET()
+		}
+		emitter.Close()
+
+		summary := output.Summary()
+		delivered, dropped := summary["delivered"]-before["delivered"], summary["dropped"]-before["dropped"]
+		if tt.drained && (delivered != 20 || dropped != 0 || summary["pending"] != 0) {
+			t.Errorf("drain %s: expected all 20 requests to be delivered: %v", tt.drainTimeout, summary)
+		}
+		if !tt.drained && (delivered == 20 || dropped == 0) {
+			t.Errorf("drain %s: expected requests queued after deadline to be dropped: %v", tt.drainTimeout, summary)
+		}
+		server.Close()
+		if tt.drained && atomic.LoadInt64(&received) != 20 {
+			t.Errorf("drain %s: expected 20 requests, got %d", tt.drainTimeout, received)
+		}
+	}
+}
+
+// messageInput returns its messages and then ErrorStopped
+type messageInput []*Message
+
+func (i *messageInput) PluginRead() (*Message, error) {
+	if len(*i) == 0 {
+		return nil, ErrorStopped
+	}
+	msg := (*i)[0]
+	*i = (*i)[1:]
+	return msg, nil
+}
+
+func TestEmitterCopyBufferSize(t *testing.T) {
+	defer func(limit size.Size) { Settings.CopyBufferSize = limit }(Settings.CopyBufferSize)
+	Settings.CopyBufferSize = 100
+
+	body := strings.Repeat("x", 200)
+	frame := appendWSFrame(nil, wsFrame{fin: true, opcode: wsText, payload: []byte(body)}, nil)
+	input := &messageInput{
+		{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("POST /plain HTTP/1.1\r\nContent-Length: 200\r\n\r\n" + body)},
+		{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("POST /chunked HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\n\r\nc8\r\n" + body + "\r\n0\r\nGrpc-Status: 0\r\n\r\n")},
+		{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1, MetaField("truncated", "1")), Data: []byte("POST /input HTTP/1.1\r\nContent-Length: 200\r\n\r\n" + body)},
+		{Meta: PayloadHeader(WebSocketPayload, Uuid(), 1, -1), Data: frame},
+	}
+	var written []*Message
+	output := NewTestOutput(func(msg *Message) { written = append(written, msg) })
+	CopyMulty(input, output)
+
+	if len(written) != 4 {
+		t.Fatalf("Expected 4 messages, got %d", len(written))
+	}
+	for _, msg := range written[:2] {
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg.Data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := ioutil.ReadAll(req.Body)
+		if _, truncated := PayloadMetaField(msg.Meta, "truncated"); err != nil || !truncated || len(msg.Data) > 100 ||
+			len(received) == 0 || strings.Trim(string(received), "x") != "" {
+			t.Errorf("Expected truncated request to be parseable: %q %q", msg.Meta, msg.Data)
+		}
+	}
+	if len(written[2].Data) <= 100 {
+		t.Errorf("Request truncated by the input should be left alone: %q", written[2].Data)
+	}
+	if f, _, ok := parseWSFrame(written[3].Data); !ok || string(f.payload) != body {
+		t.Error("WebSocket frames should not be truncated")
+	}
+}
@@ -0,0 +1,110 @@
+package httpreplay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gRPC calls are recorded like any other request: length-prefixed messages are kept in the body as is,
+// and trailers carrying grpc-status are kept with chunked encoding of the HTTP/1.1 wire format.
+
+// isGRPC reports whether the message has gRPC content type, gRPC-Web is plain HTTP and is not included
+func isGRPC(header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcStatus returns grpc-status of gRPC response, or "" for other responses.
+// It is sent in trailers, which are only known once the body is read, or in headers of trailers-only responses.
+func grpcStatus(resp *http.Response) string {
+	if !isGRPC(resp.Header) {
+		return ""
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "" {
+		return status
+	}
+	return resp.Header.Get("Grpc-Status")
+}
+
+// hasTrailer reports whether any trailer has been received, declared trailers have no values until then
+func hasTrailer(trailer http.Header) bool {
+	for _, values := range trailer {
+		if len(values) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpGRPCResponse returns the response in HTTP/1.1 wire format with chunked body followed by trailers.
+// The body is read whole and resp.Body is replaced so that it can be read again.
+func dumpGRPCResponse(resp *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	dump := *resp
+	dump.Proto, dump.ProtoMajor, dump.ProtoMinor = "HTTP/1.1", 1, 1
+	dump.TransferEncoding = []string{"chunked"}
+	dump.ContentLength = -1
+	dump.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var buf bytes.Buffer
+	if err := dump.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeGRPCOK answers a mirrored gRPC call with trailers-only OK response
+func writeGRPCOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", "0")
+	w.WriteHeader(http.StatusOK)
+}
+
+// newGRPCTransport returns copy of the output transport which always uses HTTP/2, as gRPC requires:
+// over TLS for https:// targets and h2c otherwise
+func newGRPCTransport(transport *http.Transport, target *url.URL) *http.Transport {
+	grpc := transport.Clone()
+	grpc.Protocols = new(http.Protocols)
+	if target.Scheme == "https" {
+		grpc.Protocols.SetHTTP2(true)
+	} else {
+		grpc.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return grpc
+}
+
+// grpcRoundTripper sends gRPC calls with the grpc transport and other requests with the http one
+type grpcRoundTripper struct {
+	http, grpc http.RoundTripper
+}
+
+func (t *grpcRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isGRPC(req.Header) {
+		return t.grpc.RoundTrip(req)
+	}
+	return t.http.RoundTrip(req)
+}
+
+// prepareGRPCRequest removes HTTP/1.1 connection headers of the recorded call, which are invalid in HTTP/2
+func prepareGRPCRequest(req *http.Request) {
+	removeConnectionHeaders(req.Header)
+	req.Header.Set("Te", "trailers")
+}
+
+// discardBody reads the rest of the body so that trailers are received, and closes it
+func discardBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,171 @@
+package httpreplay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// grpcFrame returns length-prefixed gRPC message
+func grpcFrame(message string) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// newGRPCServer starts h2c server echoing the request message, calls of /test.Echo/Fail fail with NOT_FOUND
+func newGRPCServer(t *testing.T) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !isGRPC(r.Header) || r.Header.Get("Te") != "trailers" {
+			t.Errorf("Expected gRPC call over HTTP/2, got %s %v", r.Proto, r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(body)
+		if r.URL.Path == "/test.Echo/Fail" {
+			w.Header().Set("Grpc-Status", "5")
+		} else {
+			w.Header().Set("Grpc-Status", "0")
+		}
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func newGRPCRequest(t *testing.T, url, message string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(grpcFrame(message)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	return req
+}
+
+func TestGRPCCapture(t *testing.T) {
+	backend := newGRPCServer(t)
+	defer backend.Close()
+
+	mirror := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
+	defer mirror.Close()
+	proxy := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{Upstream: backend.URL})
+	defer proxy.Close()
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: h2c}}
+
+	// mirrored call with request trailer gets empty OK status
+	req := newGRPCRequest(t, "http://"+mirror.address+"/test.Echo/Say", "hello")
+	req.Trailer = http.Header{"X-Checksum": {"abc"}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if grpcStatus(resp) != "0" {
+		t.Errorf("Expected mirror to answer with grpc-status 0: %v", resp.Header)
+	}
+	msg, _ := mirror.PluginRead()
+	recorded, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg.Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(recorded.Body)
+	if !bytes.Equal(body, grpcFrame("hello")) || recorded.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("Expected message framing and trailer to be kept: %q", msg.Data)
+	}
+
+	// proxied call records the response with trailers
+	resp, err = client.Do(newGRPCRequest(t, "http://"+proxy.address+"/test.Echo/Fail", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, grpcFrame("hello")) || grpcStatus(resp) != "5" {
+		t.Errorf("Expected upstream response with trailers, got %q %v", body, resp.Trailer)
+	}
+	proxy.PluginRead()
+	msg, _ = proxy.PluginRead()
+	if msg.Meta[0] != ResponsePayload {
+		t.Fatalf("Expected recorded response, got %q", msg.Meta)
+	}
+	recordedResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msg.Data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(recordedResp.Body)
+	if !bytes.HasPrefix(msg.Data, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.Equal(body, grpcFrame("hello")) || grpcStatus(recordedResp) != "5" {
+		t.Errorf("Expected response in HTTP/1.1 format with grpc-status trailer: %q", msg.Data)
+	}
+}
+
+func TestGRPCReplay(t *testing.T) {
+	backend := newGRPCServer(t)
+	defer backend.Close()
+
+	output := NewHTTPOutput(backend.URL, &HTTPOutputConfig{TrackResponses: true}).(*HTTPOutput)
+	defer output.Close()
+	before := output.Summary()
+
+	request := "POST /test.Echo/Fail HTTP/1.1\r\nHost: backend\r\nConnection: keep-alive\r\nContent-Type: application/grpc\r\nContent-Length: 10\r\n\r\n"
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: append([]byte(request), grpcFrame("hello")...)})
+
+	done := make(chan *Message)
+	go func() {
+		msg, _ := output.PluginRead()
+		done <- msg
+	}()
+	select {
+	case msg := <-done:
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msg.Data)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if !bytes.Equal(body, grpcFrame("hello")) || grpcStatus(resp) != "5" {
+			t.Errorf("Expected replayed response with grpc-status trailer: %q", msg.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Response was not received:", output.Summary())
+	}
+
+	if summary := output.Summary(); summary["grpc_errors"]-before["grpc_errors"] != 1 {
+		t.Errorf("Expected failed call to be counted: %v", summary)
+	}
+	var scrape strings.Builder
+	metrics.WriteTo(&scrape)
+	if !strings.Contains(scrape.String(), `httpcopy_http_output_grpc_responses_total{target="`+output.config.rawURL+`",status="5"}`) {
+		t.Error("Expected grpc-status to be reported in metrics")
+	}
+}
+
+func TestCompareOutputGRPCStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.jsonl")
+	output := NewCompareOutput(path, &CompareOutputConfig{})
+
+	response := func(status string) []byte {
+		return []byte("HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\n\r\n" +
+			"0\r\nGrpc-Status: " + status + "\r\n\r\n")
+	}
+	output.PluginWrite(&Message{Meta: []byte("2 a 2 1\n"), Data: response("0")})
+	output.PluginWrite(&Message{Meta: []byte("3 a 3 1\n"), Data: response("14")})
+	output.Close()
+
+	mismatches, _ := readCompareReport(t, path)
+	if len(mismatches) != 1 || !reflect.DeepEqual(mismatches[0].GRPC, []string{"0", "14"}) {
+		t.Errorf("Expected grpc-status mismatch, got %+v", mismatches)
+	}
+}
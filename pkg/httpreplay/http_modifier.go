@@ -0,0 +1,151 @@
+package httpreplay
+
+import (
+	"bytes"
+	"strings"
+
+	"httpcopy/pkg/proto"
+)
+
+// modifierStats counts requests dropped by each filter, e.g. "http-disallow-url:^/health"
+var modifierStats = expvarMap("http-modifier")
+
+// HTTPModifier filters and rewrites requests passing from inputs to outputs
+type HTTPModifier struct {
+	config *HTTPModifierConfig
+}
+
+// NewHTTPModifier returns modifier for config, or nil if there is nothing to do
+func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
+	// Optimization to skip modifier completely if we do not need it
+	if len(config.URLRegexp) == 0 &&
+		len(config.URLNegativeRegexp) == 0 &&
+		len(config.HeaderFilters) == 0 &&
+		len(config.HeaderNegativeFilters) == 0 &&
+		len(config.Methods) == 0 &&
+		len(config.URLRewrite) == 0 &&
+		len(config.HeaderRewrite) == 0 &&
+		len(config.Headers) == 0 &&
+		len(config.HeadersRemove) == 0 &&
+		len(config.Params) == 0 {
+		return nil
+	}
+
+	return &HTTPModifier{config: config}
+}
+
+// Rewrite returns modified request payload, or nil if the request should be dropped
+func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
+	if !proto.HasRequestTitle(payload) {
+		return payload
+	}
+
+	if len(m.config.Methods) > 0 {
+		method := proto.Method(payload)
+
+		matched := false
+
+		for _, allowed := range m.config.Methods {
+			if bytes.Equal(method, allowed) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return m.drop("http-allow-method:" + strings.Join(m.config.Methods.Get().([]string), ","))
+		}
+	}
+
+	if len(m.config.URLRegexp) > 0 {
+		path := proto.Path(payload)
+
+		matched := false
+
+		for _, f := range m.config.URLRegexp {
+			if f.regexp.Match(path) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return m.drop("http-allow-url:" + strings.Join(m.config.URLRegexp.Get().([]string), ","))
+		}
+	}
+
+	if len(m.config.URLNegativeRegexp) > 0 {
+		path := proto.Path(payload)
+
+		for _, f := range m.config.URLNegativeRegexp {
+			if f.regexp.Match(path) {
+				return m.drop("http-disallow-url:" + f.String())
+			}
+		}
+	}
+
+	if len(m.config.HeaderFilters) > 0 {
+		for _, f := range m.config.HeaderFilters {
+			value := proto.Header(payload, f.name)
+
+			if len(value) == 0 || !f.regexp.Match(value) {
+				return m.drop("http-allow-header:" + f.String())
+			}
+		}
+	}
+
+	if len(m.config.HeaderNegativeFilters) > 0 {
+		for _, f := range m.config.HeaderNegativeFilters {
+			value := proto.Header(payload, f.name)
+
+			if len(value) > 0 && f.regexp.Match(value) {
+				return m.drop("http-disallow-header:" + f.String())
+			}
+		}
+	}
+
+	if len(m.config.URLRewrite) > 0 {
+		path := proto.Path(payload)
+
+		for _, f := range m.config.URLRewrite {
+			if f.src.Match(path) {
+				path = f.src.ReplaceAll(path, f.target)
+				payload = proto.SetPath(payload, path)
+
+				break
+			}
+		}
+	}
+
+	for _, p := range m.config.Params {
+		payload = proto.SetPathParam(payload, p.Name, p.Value)
+	}
+
+	for _, f := range m.config.HeaderRewrite {
+		value := proto.Header(payload, f.header)
+		if value == nil {
+			continue
+		}
+
+		if f.src.Match(value) {
+			newValue := f.src.ReplaceAll(value, f.target)
+			payload = proto.SetHeader(payload, f.header, newValue)
+		}
+	}
+
+	for _, header := range m.config.Headers {
+		payload = proto.SetHeader(payload, []byte(header.Name), []byte(header.Value))
+	}
+
+	for _, name := range m.config.HeadersRemove {
+		payload = proto.DeleteHeader(payload, []byte(name))
+	}
+
+	return payload
+}
+
+func (m *HTTPModifier) drop(filter string) []byte {
+	modifierStats.Add(filter, 1)
+	metrics.Counter("httpcopy_filtered_total", "Requests dropped by filters.", "filter", filter).Add(1)
+	return nil
+}
@@ -0,0 +1,298 @@
+package httpreplay
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// HTTPModifierConfig holds configuration options for built-in traffic modifier
+type HTTPModifierConfig struct {
+	URLNegativeRegexp     HTTPURLRegexp     `json:"http-disallow-url"`
+	URLRegexp             HTTPURLRegexp     `json:"http-allow-url"`
+	HeaderFilters         HTTPHeaderFilters `json:"http-allow-header"`
+	HeaderNegativeFilters HTTPHeaderFilters `json:"http-disallow-header"`
+	Methods               HTTPMethods       `json:"http-allow-method"`
+
+	URLRewrite    HTTPURLRewriteMap `json:"http-rewrite-url"`
+	HeaderRewrite HTTPHeaderRewrite `json:"http-rewrite-header"`
+	Headers       HTTPHeaders       `json:"http-set-header"`
+	HeadersRemove HTTPHeaderNames   `json:"http-remove-header"`
+	Params        HTTPParams        `json:"http-set-param"`
+}
+
+// HTTPHeaderFilters holds list of headers and their regexps
+type HTTPHeaderFilters []headerFilter
+
+type headerFilter struct {
+	name   []byte
+	regexp *regexp.Regexp
+}
+
+func (f headerFilter) String() string {
+	return string(f.name) + ":" + f.regexp.String()
+}
+
+func (h *HTTPHeaderFilters) String() string {
+	return fmt.Sprint(*h)
+}
+
+// Get returns values in the format accepted by Set
+func (h *HTTPHeaderFilters) Get() interface{} {
+	values := []string{}
+	for _, v := range *h {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (h *HTTPHeaderFilters) Set(value string) error {
+	valArr := strings.SplitN(value, ":", 2)
+	if len(valArr) < 2 {
+		return errors.New("need both header and value, colon-delimited (ex. user_id:^169$)")
+	}
+	val := strings.TrimSpace(valArr[1])
+	r, err := regexp.Compile(val)
+	if err != nil {
+		return err
+	}
+
+	*h = append(*h, headerFilter{name: []byte(strings.TrimSpace(valArr[0])), regexp: r})
+
+	return nil
+}
+
+// HTTPURLRegexp a regexp that can be used as a flag value
+type HTTPURLRegexp []urlRegexp
+
+type urlRegexp struct {
+	regexp *regexp.Regexp
+}
+
+func (r urlRegexp) String() string {
+	return r.regexp.String()
+}
+
+func (r *HTTPURLRegexp) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Get returns values in the format accepted by Set
+func (r *HTTPURLRegexp) Get() interface{} {
+	values := []string{}
+	for _, v := range *r {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (r *HTTPURLRegexp) Set(value string) error {
+	regexp, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+
+	*r = append(*r, urlRegexp{regexp: regexp})
+
+	return nil
+}
+
+// HTTPMethods holds values for method allowed
+type HTTPMethods [][]byte
+
+func (h *HTTPMethods) String() string {
+	return fmt.Sprintf("%s", *h)
+}
+
+// Get returns values in the format accepted by Set
+func (h *HTTPMethods) Get() interface{} {
+	values := []string{}
+	for _, v := range *h {
+		values = append(values, string(v))
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (h *HTTPMethods) Set(value string) error {
+	*h = append(*h, []byte(strings.ToUpper(value)))
+	return nil
+}
+
+// HTTPURLRewriteMap holds regexps and replacements for request URI
+type HTTPURLRewriteMap []urlRewrite
+
+type urlRewrite struct {
+	src    *regexp.Regexp
+	target []byte
+}
+
+func (r urlRewrite) String() string {
+	return r.src.String() + ":" + string(r.target)
+}
+
+func (r *HTTPURLRewriteMap) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Get returns values in the format accepted by Set
+func (r *HTTPURLRewriteMap) Get() interface{} {
+	values := []string{}
+	for _, v := range *r {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (r *HTTPURLRewriteMap) Set(value string) error {
+	valArr := strings.SplitN(value, ":", 2)
+	if len(valArr) < 2 {
+		return errors.New("need both src and target, colon-delimited (ex. /a:/b)")
+	}
+	regexp, err := regexp.Compile(valArr[0])
+	if err != nil {
+		return err
+	}
+	*r = append(*r, urlRewrite{src: regexp, target: []byte(valArr[1])})
+	return nil
+}
+
+// HTTPHeaderRewrite holds regexps and replacements for header values
+type HTTPHeaderRewrite []headerRewrite
+
+type headerRewrite struct {
+	header []byte
+	src    *regexp.Regexp
+	target []byte
+}
+
+func (r headerRewrite) String() string {
+	return string(r.header) + ": " + r.src.String() + "," + string(r.target)
+}
+
+func (h *HTTPHeaderRewrite) String() string {
+	return fmt.Sprint(*h)
+}
+
+// Get returns values in the format accepted by Set
+func (h *HTTPHeaderRewrite) Get() interface{} {
+	values := []string{}
+	for _, v := range *h {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (h *HTTPHeaderRewrite) Set(value string) error {
+	headerArr := strings.SplitN(value, ":", 2)
+	if len(headerArr) < 2 {
+		return errors.New("need both header and value, colon-delimited (ex. Host: (.*).example.com,$1.beta.example.com)")
+	}
+	valArr := strings.SplitN(strings.TrimSpace(headerArr[1]), ",", 2)
+	if len(valArr) < 2 {
+		return errors.New("need both src and target, comma-delimited (ex. Host: (.*).example.com,$1.beta.example.com)")
+	}
+	regexp, err := regexp.Compile(valArr[0])
+	if err != nil {
+		return err
+	}
+	*h = append(*h, headerRewrite{header: []byte(strings.TrimSpace(headerArr[0])), src: regexp, target: []byte(valArr[1])})
+	return nil
+}
+
+// HTTPHeaders holds headers to set on every request
+type HTTPHeaders []httpHeader
+
+type httpHeader struct {
+	Name  string
+	Value string
+}
+
+func (h httpHeader) String() string {
+	return h.Name + ": " + h.Value
+}
+
+func (h *HTTPHeaders) String() string {
+	return fmt.Sprint(*h)
+}
+
+// Get returns values in the format accepted by Set
+func (h *HTTPHeaders) Get() interface{} {
+	values := []string{}
+	for _, v := range *h {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (h *HTTPHeaders) Set(value string) error {
+	v := strings.SplitN(value, ":", 2)
+	if len(v) != 2 {
+		return errors.New("expected `Key: Value`")
+	}
+	*h = append(*h, httpHeader{Name: strings.TrimSpace(v[0]), Value: strings.TrimSpace(v[1])})
+	return nil
+}
+
+// HTTPHeaderNames holds names of headers to remove from every request
+type HTTPHeaderNames []string
+
+func (h *HTTPHeaderNames) String() string {
+	return fmt.Sprint(*h)
+}
+
+// Get returns values in the format accepted by Set
+func (h *HTTPHeaderNames) Get() interface{} {
+	return append([]string{}, *h...)
+}
+
+// Set method to implement flags.Value
+func (h *HTTPHeaderNames) Set(value string) error {
+	name := strings.TrimSpace(value)
+	if name == "" {
+		return errors.New("expected header name")
+	}
+	*h = append(*h, name)
+	return nil
+}
+
+// HTTPParams holds query parameters to set on every request
+type HTTPParams []httpParam
+
+type httpParam struct {
+	Name  []byte
+	Value []byte
+}
+
+func (p httpParam) String() string {
+	return string(p.Name) + "=" + string(p.Value)
+}
+
+func (h *HTTPParams) String() string {
+	return fmt.Sprint(*h)
+}
+
+// Get returns values in the format accepted by Set
+func (h *HTTPParams) Get() interface{} {
+	values := []string{}
+	for _, v := range *h {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (h *HTTPParams) Set(value string) error {
+	v := strings.SplitN(value, "=", 2)
+	if len(v) != 2 || v[0] == "" {
+		return errors.New("expected `key=value`")
+	}
+	*h = append(*h, httpParam{Name: []byte(v[0]), Value: []byte(v[1])})
+	return nil
+}
@@ -0,0 +1,127 @@
+package httpreplay
+
+import (
+	"bytes"
+	"expvar"
+	"sync"
+	"testing"
+)
+
+func TestHTTPModifierWithoutOptions(t *testing.T) {
+	if NewHTTPModifier(&HTTPModifierConfig{}) != nil {
+		t.Error("If no options specified should not initialize modifier")
+	}
+}
+
+func TestHTTPModifierURLFilters(t *testing.T) {
+	var config HTTPModifierConfig
+	config.URLRegexp.Set("^/api/")
+	config.URLNegativeRegexp.Set("^/api/health")
+	modifier := NewHTTPModifier(&config)
+
+	tests := []struct {
+		payload string
+		allowed bool
+	}{
+		{"GET /api/users HTTP/1.1\r\n\r\n", true},
+		{"GET /static/app.js HTTP/1.1\r\n\r\n", false},
+		{"GET /api/health?full=1 HTTP/1.1\r\n\r\n", false},
+		{"HTTP/1.1 200 OK\r\n\r\n", true},
+	}
+	for _, tt := range tests {
+		if allowed := len(modifier.Rewrite([]byte(tt.payload))) > 0; allowed != tt.allowed {
+			t.Errorf("Expected %q allowed to be %v", tt.payload, tt.allowed)
+		}
+	}
+	for _, key := range []string{"http-allow-url:^/api/", "http-disallow-url:^/api/health"} {
+		if v, ok := modifierStats.Get(key).(*expvar.Int); !ok || v.Value() < 1 {
+			t.Errorf("Expected drop to be counted per filter in %q", key)
+		}
+	}
+}
+
+func TestHTTPModifierMethodAndHeaderFilters(t *testing.T) {
+	var config HTTPModifierConfig
+	config.Methods.Set("get")
+	config.Methods.Set("POST")
+	config.HeaderFilters.Set("Api-Version: ^v1$")
+	config.HeaderNegativeFilters.Set("User-Agent: Replayed")
+	modifier := NewHTTPModifier(&config)
+
+	tests := []struct {
+		payload string
+		allowed bool
+	}{
+		{"GET / HTTP/1.1\r\nApi-Version: v1\r\n\r\n", true},
+		{"POST / HTTP/1.1\r\napi-version: v1\r\nUser-Agent: curl\r\n\r\n", true},
+		{"DELETE / HTTP/1.1\r\nApi-Version: v1\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nApi-Version: v2\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nApi-Version: v1\r\nUser-Agent: Replayed by Gor\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		if allowed := len(modifier.Rewrite([]byte(tt.payload))) > 0; allowed != tt.allowed {
+			t.Errorf("Expected %q allowed to be %v", tt.payload, tt.allowed)
+		}
+	}
+	if v, ok := modifierStats.Get("http-allow-method:GET,POST").(*expvar.Int); !ok || v.Value() < 1 {
+		t.Error("Expected drop to be counted with allowed methods")
+	}
+}
+
+func TestHTTPModifierRewrite(t *testing.T) {
+	var config HTTPModifierConfig
+	config.URLRewrite.Set("/v1/user/([^\\/]+)/ping:/v2/user/$1/ping")
+	config.Params.Set("api_key=staging")
+	config.HeaderRewrite.Set("Host: (.*).example.com,$1.beta.example.com")
+	config.Headers.Set("X-Env: staging")
+	config.HeadersRemove.Set("authorization")
+	modifier := NewHTTPModifier(&config)
+
+	payload := []byte("GET /v1/user/joe/ping?api_key=prod HTTP/1.1\r\nHost: api.example.com\r\nAuthorization: Bearer x\r\n\r\n")
+	expected := []byte("GET /v2/user/joe/ping?api_key=staging HTTP/1.1\r\nX-Env: staging\r\nHost: api.beta.example.com\r\n\r\n")
+	if result := modifier.Rewrite(payload); !bytes.Equal(result, expected) {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+
+	response := []byte("HTTP/1.1 200 OK\r\nAuthorization: Bearer x\r\n\r\n")
+	if result := modifier.Rewrite(response); !bytes.Equal(result, response) {
+		t.Errorf("Responses should not be modified, got %q", result)
+	}
+}
+
+func TestEmitterFilteredResponses(t *testing.T) {
+	defer func(config HTTPModifierConfig) { Settings.ModifierConfig = config }(Settings.ModifierConfig)
+	Settings.ModifierConfig = HTTPModifierConfig{}
+	Settings.ModifierConfig.URLNegativeRegexp.Set("^/health")
+
+	wg := new(sync.WaitGroup)
+	input := NewTestInput()
+	input.skipHeader = true
+	var received [][]byte
+	output := NewTestOutput(func(msg *Message) {
+		received = append(received, msg.Meta)
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+
+	wg.Add(2)
+	input.EmitBytes([]byte("1 a 1 -1\nGET /health HTTP/1.1\r\n\r\n"))
+	input.EmitBytes([]byte("2 a 2 1\nHTTP/1.1 200 OK\r\n\r\n"))
+	input.EmitBytes([]byte("1 b 3 -1\nGET /users HTTP/1.1\r\n\r\n"))
+	input.EmitBytes([]byte("2 b 4 1\nHTTP/1.1 200 OK\r\n\r\n"))
+	wg.Wait()
+	emitter.Close()
+
+	if len(received) != 2 || !bytes.Equal(PayloadID(received[0]), []byte("b")) || !bytes.Equal(PayloadID(received[1]), []byte("b")) {
+		t.Errorf("Expected filtered request and its response to be dropped: %q", received)
+	}
+}
@@ -219,6 +219,9 @@ func NewFileInput(path string, loop bool, readDepth int, maxWait time.Duration,
 	i.stats = expvar.NewMap("file-" + path)
 	i.dryRun = dryRun
 	i.maxWait = maxWait
+	metrics.GaugeFunc("httpcopy_plugin_queue_depth", "Messages waiting in the plugin queue.", func() float64 {
+		return float64(len(i.data))
+	}, "plugin", i.String())
 
 	if err := i.init(); err != nil {
 		return
@@ -1,58 +1,596 @@
 package httpreplay
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"httpcopy/pkg/size"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
+// Overflow policies of HTTPInput, applied when its queue is full
+const (
+	OverflowBlock      = "block"
+	OverflowDropNewest = "drop-newest"
+	OverflowDropOldest = "drop-oldest"
+	OverflowSpill      = "spill"
+)
+
+// HTTPInputConfig struct for holding http input configuration
+type HTTPInputConfig struct {
+	Upstream     string        `json:"input-http-upstream"`
+	TLSCert      string        `json:"input-http-tls-cert"`
+	TLSKey       string        `json:"input-http-tls-key"`
+	TLSClientCA  string        `json:"input-http-tls-client-ca"`
+	QueueLen     int           `json:"input-http-queue-len"`
+	Overflow     string        `json:"input-http-overflow"`
+	BlockTimeout time.Duration `json:"input-http-block-timeout"`
+	SpillDir     string        `json:"input-http-spill-dir"`
+	// RejectOversize responds with 413 instead of recording a truncated body
+	RejectOversize bool      `json:"input-http-reject-oversize"`
+	BufferSize     size.Size `json:"-"` // see Settings.CopyBufferSize
+	// OriginalHost records the virtual host the request was mirrored from instead of the one it was sent to
+	OriginalHost  bool `json:"input-http-original-host"`
+	MirrorHeaders bool `json:"input-http-mirror-headers"`
+	ProxyProtocol bool `json:"input-http-proxy-protocol"`
+	// Responses and ResponseHeaders answer mirrored requests instead of the default 200 OK
+	Responses       HTTPInputResponses       `json:"input-http-response"`
+	ResponseHeaders HTTPInputResponseHeaders `json:"input-http-response-header"`
+	// RespondAfterQueue holds the response until the request is queued, so clients see backpressure and drops as 503
+	RespondAfterQueue bool `json:"input-http-respond-after-queue"`
+}
+
 // HTTPInput used for sending requests to Gor via http
 type HTTPInput struct {
-	data     chan []byte
-	address  string
-	listener net.Listener
-	stop     chan bool // Channel used only to indicate goroutine should shutdown
+	data      chan *Message
+	address   string
+	config    *HTTPInputConfig
+	proxy     *httputil.ReverseProxy
+	listener  net.Listener
+	server    *http.Server
+	spill     *diskQueue
+	unspilled chan struct{} // closed when unspill returns
+	stats     *expvar.Map
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
+}
+
+type proxyContextKey struct{}
+
+// proxyRequest carries request identity from handler to the reverse proxy hooks
+type proxyRequest struct {
+	uuid    []byte
+	start   time.Time
+	dropped bool // the request wasn't queued, so its response isn't recorded either
 }
 
 // NewHTTPInput constructor for HTTPInput. Accepts address with port which it will listen on.
-func NewHTTPInput(address string) (i *HTTPInput) {
+// If config.Upstream is set, every request is proxied to it and the upstream response is recorded as well.
+func NewHTTPInput(address string, config *HTTPInputConfig) (i *HTTPInput) {
 	i = new(HTTPInput)
-	i.data = make(chan []byte, 1000)
 	i.stop = make(chan bool)
+	newConfig := *config
+	i.config = &newConfig
+
+	if i.config.BufferSize <= 0 {
+		i.config.BufferSize = 5 << 20 // 5mb
+	}
+	if i.config.QueueLen <= 0 {
+		i.config.QueueLen = 1000
+	}
+	i.data = make(chan *Message, i.config.QueueLen)
+
+	switch i.config.Overflow {
+	case "":
+		i.config.Overflow = OverflowBlock
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	case OverflowSpill:
+		var err error
+		if i.spill, err = newDiskQueue(i.config.SpillDir); err != nil {
+			log.Fatal(fmt.Sprintf("[INPUT-HTTP] spill queue error[%q]", err))
+		}
+		i.unspilled = make(chan struct{})
+		go i.unspill()
+	default:
+		log.Fatal(fmt.Sprintf("[INPUT-HTTP] unknown overflow policy %q", i.config.Overflow))
+	}
+
+	if i.config.Upstream != "" {
+		upstream, err := url.Parse(i.config.Upstream)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("[INPUT-HTTP] parse upstream URL error[%q]", err))
+		}
+		if upstream.Scheme == "" {
+			upstream.Scheme = "http"
+		}
+		i.proxy = httputil.NewSingleHostReverseProxy(upstream)
+		i.proxy.ModifyResponse = i.recordResponse
+		transport := http.DefaultTransport.(*http.Transport)
+		i.proxy.Transport = &grpcRoundTripper{http: transport, grpc: newGRPCTransport(transport, upstream)}
+	}
 
 	i.listen(address)
 
 	return
 }
 
+// httpInputShutdownTimeout is how long Close waits for requests being received
+var httpInputShutdownTimeout = 5 * time.Second
+
 // PluginRead reads message from this plugin
 func (i *HTTPInput) PluginRead() (*Message, error) {
-	var msg Message
 	select {
 	case <-i.stop:
-		return nil, ErrorStopped
-	case buf := <-i.data:
-		msg.Data = buf
-		msg.Meta = PayloadHeader(RequestPayload, Uuid(), time.Now().UnixNano(), -1)
-		return &msg, nil
+		// requests received before Close are still delivered
+		select {
+		case msg := <-i.data:
+			return msg, nil
+		default:
+			return nil, ErrorStopped
+		}
+	case msg := <-i.data:
+		return msg, nil
 	}
 }
 
-// Close closes this plugin
+// Close stops accepting connections and waits for requests being received to be queued,
+// queued requests are returned by PluginRead until the queue is empty.
 func (i *HTTPInput) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), httpInputShutdownTimeout)
+	defer cancel()
+	err := i.server.Shutdown(ctx)
+
 	close(i.stop)
-	return nil
+	if i.spill != nil {
+		i.spill.Close()
+		<-i.unspilled
+		// including the message unspill was holding
+		if n := i.spill.Len(); n > 0 {
+			Debug(0, fmt.Sprintf("[INPUT-HTTP] dropping %d spilled requests", n))
+			i.stats.Add("dropped", int64(n))
+		}
+	}
+	return err
+}
+
+// enqueue hands message over to PluginRead, applying the overflow policy if the queue is full.
+// Proxied clients don't wait for the queue unless --input-http-block-timeout is set.
+// Returns false if the message was dropped.
+func (i *HTTPInput) enqueue(msg *Message) bool {
+	switch i.config.Overflow {
+	case OverflowDropNewest:
+		select {
+		case i.data <- msg:
+		default:
+			i.stats.Add("dropped", 1)
+			return false
+		}
+	case OverflowDropOldest:
+		for queued := false; !queued; {
+			select {
+			case i.data <- msg:
+				queued = true
+			default:
+				select {
+				case <-i.data:
+					i.stats.Add("dropped", 1)
+				default:
+				}
+			}
+		}
+	case OverflowSpill:
+		// once spilling started keep using the disk queue to preserve ordering
+		if i.spill.Len() == 0 {
+			select {
+			case i.data <- msg:
+				i.stats.Add("queued", 1)
+				return true
+			default:
+			}
+		}
+		if err := i.spill.Push(msg); err != nil {
+			Debug(1, fmt.Sprintf("[INPUT-HTTP] spill error: %q", err))
+			i.stats.Add("dropped", 1)
+			return false
+		}
+		i.stats.Add("spilled", 1)
+		return true
+	default:
+		if i.proxy != nil && i.config.BlockTimeout <= 0 {
+			// a stalled output must not hold up proxied traffic
+			select {
+			case i.data <- msg:
+			default:
+				i.stats.Add("dropped", 1)
+				return false
+			}
+			break
+		}
+		var timeout <-chan time.Time
+		if i.config.BlockTimeout > 0 {
+			timer := time.NewTimer(i.config.BlockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case i.data <- msg:
+		case <-timeout:
+			i.stats.Add("dropped", 1)
+			return false
+		case <-i.stop:
+			return false
+		}
+	}
+	i.stats.Add("queued", 1)
+	return true
+}
+
+// unspill moves messages from the disk queue back to memory as soon as there is room
+func (i *HTTPInput) unspill() {
+	defer close(i.unspilled)
+	for {
+		msg, err := i.spill.Pop()
+		if err != nil {
+			if err != ErrorStopped {
+				Debug(1, fmt.Sprintf("[INPUT-HTTP] spill read error: %q", err))
+			}
+			return
+		}
+		// the message still counts as spilled, so new requests are queued after it
+		select {
+		case i.data <- msg:
+			i.spill.Done()
+			i.stats.Add("queued", 1)
+		case <-i.stop:
+			return
+		}
+	}
+}
+
+func (i *HTTPInput) queueDepth() int {
+	if i.spill != nil {
+		return len(i.data) + i.spill.Len()
+	}
+	return len(i.data)
 }
 
 func (i *HTTPInput) handler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	uuid := Uuid()
+
+	var extras []string
+	if ip := i.clientIP(r); ip != "" {
+		extras = append(extras, MetaField("ip", ip))
+	}
+	if i.config.MirrorHeaders {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			extras = append(extras, MetaField("scheme", proto))
+		}
+		restoreMirroredURI(r)
+	}
+	if i.config.OriginalHost {
+		r.Host = originalHost(r)
+	}
+	if proto := requestProto(r); proto != "" {
+		extras = append(extras, MetaField("proto", proto))
+	}
+	if r.TLS != nil {
+		extras = append(extras, MetaField("tls", "1"))
+		if len(r.TLS.PeerCertificates) > 0 {
+			extras = append(extras, MetaField("tls-client", r.TLS.PeerCertificates[0].Subject.String()))
+		}
+	}
+
 	r.URL.Scheme = "http"
 	r.URL.Host = i.address
+	if i.listener.Addr().Network() == "unix" {
+		r.URL.Host = "localhost"
+	}
+	if i.config.OriginalHost {
+		r.URL.Host = r.Host
+	}
+
+	buf, truncated, err := i.dumpRequest(r)
+	if err != nil {
+		Debug(1, fmt.Sprintf("[INPUT-HTTP] error reading request: %q", err))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if truncated {
+		if i.config.RejectOversize {
+			i.stats.Add("rejected", 1)
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		i.stats.Add("truncated", 1)
+		extras = append(extras, MetaField("truncated", "1"))
+	}
+	msg := &Message{
+		Meta: PayloadHeader(RequestPayload, uuid, start.UnixNano(), -1, extras...),
+		Data: buf,
+	}
+
+	if i.proxy == nil {
+		// the rest of an oversize body is not needed, but reading it keeps the connection reusable
+		io.Copy(ioutil.Discard, r.Body)
+		if isWebSocketUpgrade(r.Header) {
+			i.enqueue(msg)
+			i.serveWebSocket(w, r, uuid)
+			return
+		}
+		if !i.config.RespondAfterQueue {
+			i.respond(w, r, uuid)
+			// the client is answered even if queueing blocks
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			i.enqueue(msg)
+			return
+		}
+		if !i.enqueue(msg) {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		i.respond(w, r, uuid)
+		return
+	}
+
+	queued := i.enqueue(msg)
+	ctx := context.WithValue(r.Context(), proxyContextKey{}, &proxyRequest{uuid: uuid, start: start, dropped: !queued})
+	i.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// clientIP returns address of the client which originally sent the request, "" if it is unknown as for unix sockets
+func (i *HTTPInput) clientIP(r *http.Request) string {
+	if i.config.MirrorHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+		if ip := r.Header.Get("X-Real-Ip"); ip != "" {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	if r.RemoteAddr == "@" {
+		// unnamed unix socket
+		return ""
+	}
+	return r.RemoteAddr
+}
+
+// requestProto returns ALPN name of the protocol the request was received with, h2c for cleartext HTTP/2,
+// or "" for HTTP/1.1. Requests are always recorded in HTTP/1.1 wire format.
+func requestProto(r *http.Request) string {
+	switch {
+	case r.ProtoMajor == 2 && r.TLS != nil:
+		return "h2"
+	case r.ProtoMajor == 2:
+		return "h2c"
+	case r.ProtoMajor == 1 && r.ProtoMinor == 0:
+		return "http/1.0"
+	}
+	return ""
+}
+
+// restoreMirroredURI recovers the original request URI, nginx mirror configurations pass it in X-Original-URI
+func restoreMirroredURI(r *http.Request) {
+	uri := r.Header.Get("X-Original-URI")
+	if uri == "" {
+		return
+	}
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		r.URL.Path, r.URL.RawPath, r.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+		r.RequestURI = uri
+	}
+	r.Header.Del("X-Original-URI")
+}
+
+// originalHost returns the virtual host of the original request.
+// Proxies pass it in X-Original-Host or X-Forwarded-Host, Envoy shadows requests to "<host>-shadow".
+func originalHost(r *http.Request) string {
+	if host := r.Header.Get("X-Original-Host"); host != "" {
+		r.Header.Del("X-Original-Host")
+		return host
+	}
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		return strings.TrimSpace(strings.Split(host, ",")[0])
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return strings.TrimSuffix(r.Host, "-shadow")
+	}
+	return net.JoinHostPort(strings.TrimSuffix(host, "-shadow"), port)
+}
+
+// dumpRequest returns the request in HTTP/1.1 wire format, whatever protocol it was received with, with the payload capped at config.BufferSize.
+// Only the recorded part of the body is held in memory, r.Body is replaced so that it still yields the whole body.
+func (i *HTTPInput) dumpRequest(r *http.Request) (dump []byte, truncated bool, err error) {
+	limit := int(i.config.BufferSize)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil {
+		return nil, false, err
+	}
+	contentLength, transferEncoding, rest := r.ContentLength, r.TransferEncoding, r.Body
+	defer func() {
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), rest))
+		r.ContentLength, r.TransferEncoding = contentLength, transferEncoding
+	}()
+
+	// trailers, e.g. of gRPC calls, are known once the whole body is read and are kept with chunked encoding
+	if len(body) <= limit && hasTrailer(r.Trailer) {
+		r.TransferEncoding, r.ContentLength = []string{"chunked"}, -1
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if dump, err = httputil.DumpRequestOut(r, true); err == nil && len(dump) <= limit {
+			return dump, false, nil
+		}
+	}
+
+	recorded := body
+	if len(recorded) > limit {
+		recorded, truncated = recorded[:limit], true
+	}
+
+	// the recorded request always has Content-Length of the recorded body so it can be replayed as is
+	header := func() ([]byte, error) {
+		r.TransferEncoding = nil
+		r.ContentLength = int64(len(recorded))
+		r.Body = http.NoBody
+		if len(recorded) > 0 {
+			r.Body = ioutil.NopCloser(bytes.NewReader(recorded))
+		}
+		return httputil.DumpRequestOut(r, false)
+	}
+
+	if dump, err = header(); err != nil {
+		return nil, false, err
+	}
+	if over := len(dump) + len(recorded) - limit; over > 0 && len(recorded) > 0 {
+		if over > len(recorded) {
+			over = len(recorded)
+		}
+		recorded, truncated = recorded[:len(recorded)-over], true
+		if dump, err = header(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return append(dump, recorded...), truncated, nil
+}
+
+// recordResponse records the upstream response as it is returned to the client, its body is copied while the client
+// reads it, so streamed responses are not held back. The response carries the same id as the request and the upstream latency.
+func (i *HTTPInput) recordResponse(resp *http.Response) error {
+	pr, ok := resp.Request.Context().Value(proxyContextKey{}).(*proxyRequest)
+	if !ok || pr.dropped {
+		return nil
+	}
+	now := time.Now()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &responseRecorder{ReadCloser: resp.Body, input: i, resp: resp, request: pr, at: now}
+		return nil
+	}
+
+	// body of upgraded connection is the stream of the new protocol
+	buf, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return err
+	}
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && isWebSocketUpgrade(resp.Header) {
+		resp.Body = i.tapWebSocket(conn, pr.uuid)
+	}
+	i.enqueue(&Message{
+		Meta: PayloadHeader(ResponsePayload, pr.uuid, now.UnixNano(), now.Sub(pr.start).Nanoseconds()),
+		Data: buf,
+	})
+	return nil
+}
+
+// responseRecorder copies up to config.BufferSize of the response body as it is read and records the response
+// once the body is read to the end or closed. A body closed before its end, e.g. by a client gone away, is recorded truncated.
+type responseRecorder struct {
+	io.ReadCloser
+	input     *HTTPInput
+	resp      *http.Response
+	request   *proxyRequest
+	at        time.Time // when the response headers came
+	body      []byte
+	truncated bool
+	recorded  bool
+}
+
+func (r *responseRecorder) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	if room := int(r.input.config.BufferSize) - len(r.body); n > room {
+		r.body = append(r.body, p[:room]...)
+		r.truncated = true
+	} else {
+		r.body = append(r.body, p[:n]...)
+	}
+	if err == io.EOF {
+		r.record(true)
+	}
+	return
+}
 
-	buf, _ := httputil.DumpRequestOut(r, true)
-	http.Error(w, http.StatusText(200), 200)
-	i.data <- buf
+func (r *responseRecorder) Close() error {
+	err := r.ReadCloser.Close()
+	r.record(false)
+	return err
+}
+
+// record enqueues the response with the copied body, complete tells whether the body was read to the end
+func (r *responseRecorder) record(complete bool) {
+	if r.recorded {
+		return
+	}
+	r.recorded = true
+	if !complete {
+		r.truncated = true
+	}
+
+	// responses are recorded in HTTP/1.1 wire format, with Content-Length of the recorded body,
+	// or chunked if the whole body is recorded with trailers, e.g. of gRPC calls
+	dump := *r.resp
+	dump.Proto, dump.ProtoMajor, dump.ProtoMinor = "HTTP/1.1", 1, 1
+	dump.Body = ioutil.NopCloser(bytes.NewReader(r.body))
+	if r.resp.Request.Method != http.MethodHead {
+		dump.TransferEncoding, dump.ContentLength = nil, int64(len(r.body))
+		if !r.truncated && hasTrailer(r.resp.Trailer) {
+			dump.TransferEncoding, dump.ContentLength = []string{"chunked"}, -1
+		}
+	}
+	var buf bytes.Buffer
+	if err := dump.Write(&buf); err != nil {
+		Debug(1, fmt.Sprintf("[INPUT-HTTP] error recording response: %q", err))
+		return
+	}
+	data := buf.Bytes()
+	if limit := int(r.input.config.BufferSize); len(data) > limit {
+		data, r.truncated = truncatePayload(data, limit), true
+	}
+
+	var extras []string
+	if r.truncated {
+		r.input.stats.Add("truncated", 1)
+		extras = append(extras, MetaField("truncated", "1"))
+	}
+	r.input.enqueue(&Message{
+		Meta: PayloadHeader(ResponsePayload, r.request.uuid, r.at.UnixNano(), r.at.Sub(r.request.start).Nanoseconds(), extras...),
+		Data: data,
+	})
+}
+
+// unixSocketPath returns path of unix:// address, e.g. unix:///run/httpcopy.sock
+func unixSocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(address, "unix://"), true
+}
+
+// removeStaleSocket removes socket file left by a process which didn't close its listener, sockets still accepting connections are kept
+func removeStaleSocket(path string) {
+	stat, err := os.Stat(path)
+	if err != nil || stat.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
 }
 
 func (i *HTTPInput) listen(address string) {
@@ -62,14 +600,54 @@ func (i *HTTPInput) listen(address string) {
 
 	mux.HandleFunc("/", i.handler)
 
-	i.listener, err = net.Listen("tcp", address)
+	if path, ok := unixSocketPath(address); ok {
+		removeStaleSocket(path)
+		i.listener, err = net.Listen("unix", path)
+		i.address = address
+	} else {
+		i.listener, err = net.Listen("tcp", address)
+	}
 	if err != nil {
 		log.Fatal("HTTP input listener failure:", err)
 	}
-	i.address = i.listener.Addr().String()
+	if i.address == "" {
+		i.address = i.listener.Addr().String()
+	}
+
+	if i.config.ProxyProtocol {
+		i.listener = &proxyProtocolListener{i.listener}
+	}
+
+	i.stats = expvarMap("input-http-" + i.address)
+	for _, key := range []string{"queued", "dropped", "spilled", "truncated", "rejected"} {
+		i.stats.Add(key, 0)
+	}
+	i.stats.Set("queue_depth", expvar.Func(func() interface{} {
+		return i.queueDepth()
+	}))
+	metrics.CounterFunc("httpcopy_plugin_dropped_total", "Messages dropped by the plugin.", func() float64 {
+		return float64(expvarInt(i.stats, "dropped"))
+	}, "plugin", i.String())
+	metrics.GaugeFunc("httpcopy_plugin_queue_depth", "Messages waiting in the plugin queue.", func() float64 {
+		return float64(i.queueDepth())
+	}, "plugin", i.String())
 
+	if i.config.TLSCert != "" || i.config.TLSKey != "" {
+		reloader, err := newTLSReloader(i.config.TLSCert, i.config.TLSKey, i.config.TLSClientCA)
+		if err != nil {
+			log.Fatal("HTTP input TLS failure: ", err)
+		}
+		i.listener = tls.NewListener(i.listener, reloader.TLSConfig())
+	}
+
+	// HTTP/2 is negotiated with ALPN over TLS, cleartext connections may use h2c with prior knowledge
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	i.server = &http.Server{Handler: mux, Protocols: protocols}
 	go func() {
-		err = http.Serve(i.listener, mux)
+		err := i.server.Serve(i.listener)
 		if err != nil && err != http.ErrServerClosed {
 			log.Fatal("HTTP input serve failure ", err)
 		}
@@ -77,5 +655,8 @@ func (i *HTTPInput) listen(address string) {
 }
 
 func (i *HTTPInput) String() string {
+	if i.proxy != nil {
+		return "HTTP input: " + i.address + " -> " + i.config.Upstream
+	}
 	return "HTTP input: " + i.address
 }
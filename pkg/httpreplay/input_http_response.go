@@ -0,0 +1,177 @@
+package httpreplay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// HTTPInputResponses holds static responses of mirrored requests, the one with the longest matching path prefix is used
+type HTTPInputResponses []inputResponse
+
+type inputResponse struct {
+	prefix string
+	status int
+	body   *template.Template
+	raw    string
+}
+
+// inputResponseData is passed to body templates
+type inputResponseData struct {
+	ID     string // id the request is recorded with
+	Method string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+}
+
+func (h *HTTPInputResponses) String() string {
+	return fmt.Sprint(h.Get())
+}
+
+// Get returns values in the format accepted by Set
+func (h *HTTPInputResponses) Get() interface{} {
+	values := []string{}
+	for _, v := range *h {
+		values = append(values, v.raw)
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (h *HTTPInputResponses) Set(value string) error {
+	v := strings.SplitN(value, ":", 3)
+	if len(v) < 2 || !strings.HasPrefix(v[0], "/") {
+		return errors.New("expected `/path-prefix:status[:body]` (ex. /webhook:200:{\"ok\":true})")
+	}
+	status, err := strconv.Atoi(v[1])
+	if err != nil || status < 200 || status > 599 {
+		return fmt.Errorf("invalid status %q", v[1])
+	}
+	r := inputResponse{prefix: v[0], status: status, raw: value}
+	if len(v) == 3 && v[2] != "" {
+		if !bodyAllowedForStatus(status) {
+			return fmt.Errorf("status %d can't have a body", status)
+		}
+		if r.body, err = template.New(v[0]).Parse(v[2]); err != nil {
+			return err
+		}
+	}
+	*h = append(*h, r)
+	return nil
+}
+
+// match returns response with the longest prefix of path, nil if there is none
+func (h HTTPInputResponses) match(path string) *inputResponse {
+	var matched *inputResponse
+	for n := range h {
+		r := &h[n]
+		if strings.HasPrefix(path, r.prefix) && (matched == nil || len(r.prefix) > len(matched.prefix)) {
+			matched = r
+		}
+	}
+	return matched
+}
+
+// HTTPInputResponseHeaders holds headers of responses to mirrored requests under a path prefix
+type HTTPInputResponseHeaders []inputResponseHeader
+
+type inputResponseHeader struct {
+	prefix string
+	httpHeader
+}
+
+func (h inputResponseHeader) String() string {
+	return h.prefix + ":" + h.httpHeader.String()
+}
+
+func (h *HTTPInputResponseHeaders) String() string {
+	return fmt.Sprint(*h)
+}
+
+// Get returns values in the format accepted by Set
+func (h *HTTPInputResponseHeaders) Get() interface{} {
+	values := []string{}
+	for _, v := range *h {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// Set method to implement flags.Value
+func (h *HTTPInputResponseHeaders) Set(value string) error {
+	v := strings.SplitN(value, ":", 3)
+	if len(v) != 3 || !strings.HasPrefix(v[0], "/") || strings.TrimSpace(v[1]) == "" {
+		return errors.New("expected `/path-prefix:Key: Value` (ex. /webhook:Content-Type: application/json)")
+	}
+	*h = append(*h, inputResponseHeader{prefix: v[0], httpHeader: httpHeader{Name: strings.TrimSpace(v[1]), Value: strings.TrimSpace(v[2])}})
+	return nil
+}
+
+// apply sets headers matching path, for the same header the longest prefix wins
+func (h HTTPInputResponseHeaders) apply(header http.Header, path string) {
+	var matched []inputResponseHeader
+	for _, v := range h {
+		if strings.HasPrefix(path, v.prefix) {
+			matched = append(matched, v)
+		}
+	}
+	sort.SliceStable(matched, func(a, b int) bool {
+		return len(matched[a].prefix) < len(matched[b].prefix)
+	})
+	for _, v := range matched {
+		header.Set(v.Name, v.Value)
+	}
+}
+
+// bodyAllowedForStatus reports whether responses with the status may have a body, see RFC 7230 section 3.3
+func bodyAllowedForStatus(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// respond answers a mirrored request with the configured response of its path, 200 OK by default
+func (i *HTTPInput) respond(w http.ResponseWriter, r *http.Request, uuid []byte) {
+	i.config.ResponseHeaders.apply(w.Header(), r.URL.Path)
+
+	response := i.config.Responses.match(r.URL.Path)
+	if response == nil {
+		if isGRPC(r.Header) {
+			writeGRPCOK(w)
+		} else {
+			http.Error(w, http.StatusText(200), 200)
+		}
+		return
+	}
+	if response.body == nil {
+		w.WriteHeader(response.status)
+		return
+	}
+
+	var body bytes.Buffer
+	data := inputResponseData{
+		ID:     string(uuid),
+		Method: r.Method,
+		Host:   r.Host,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+	}
+	if err := response.body.Execute(&body, data); err != nil {
+		Debug(1, fmt.Sprintf("[INPUT-HTTP] response template error: %q", err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(body.Bytes()))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(response.status)
+	w.Write(body.Bytes())
+}
@@ -1,9 +1,28 @@
 package httpreplay
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -11,7 +30,7 @@ import (
 func TestHTTPInput(t *testing.T) {
 	//wg := new(sync.WaitGroup)
 
-	input := NewHTTPInput("127.0.0.1:8090")
+	input := NewHTTPInput("127.0.0.1:8090", &HTTPInputConfig{})
 	time.Sleep(time.Millisecond)
 	//output := NewTestOutput(func(*Message) {
 	//	wg.Done()
@@ -44,7 +63,7 @@ func TestInputHTTPLargePayload(t *testing.T) {
 	var large [n]byte
 	large[n-1] = '0'
 
-	input := NewHTTPInput("127.0.0.1:0")
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
 	//output := NewTestOutput(func(msg *Message) {
 	//	_len := len(msg.Data)
 	//	if _len >= n { // considering http body CRLF
@@ -79,3 +98,666 @@ func TestInputHTTPLargePayload(t *testing.T) {
 	}
 	//wg.Wait()
 }
+
+func TestHTTPInputUpstream(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{Upstream: upstream.URL})
+
+	var mu sync.Mutex
+	var msgs []*Message
+	output := NewTestOutput(func(msg *Message) {
+		mu.Lock()
+		msgs = append(msgs, msg)
+		mu.Unlock()
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+	defer emitter.Close()
+
+	wg.Add(2)
+	resp, err := http.Post("http://"+input.address+"/items", "text/plain", strings.NewReader("a=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "created /items" || resp.Header.Get("X-Upstream") != "1" {
+		t.Errorf("Expected upstream response to be proxied, got %d %q", resp.StatusCode, body)
+	}
+	wg.Wait()
+
+	if !IsRequestPayload(msgs[0].Meta) || msgs[1].Meta[0] != ResponsePayload {
+		t.Fatalf("Expected request followed by response, got %q and %q", msgs[0].Meta, msgs[1].Meta)
+	}
+	if !bytes.Equal(PayloadID(msgs[0].Meta), PayloadID(msgs[1].Meta)) {
+		t.Errorf("Request and response should share the same id: %q %q", msgs[0].Meta, msgs[1].Meta)
+	}
+	if !bytes.HasSuffix(msgs[0].Data, []byte("a=1")) {
+		t.Errorf("Expected request body to be recorded: %q", msgs[0].Data)
+	}
+	if !bytes.HasPrefix(msgs[1].Data, []byte("HTTP/1.1 201 Created")) || !bytes.HasSuffix(msgs[1].Data, []byte("created /items")) {
+		t.Errorf("Expected upstream response to be recorded: %q", msgs[1].Data)
+	}
+	if latency, _ := strconv.ParseInt(string(PayloadMeta(msgs[1].Meta)[3]), 10, 64); latency <= 0 {
+		t.Errorf("Expected response latency in meta: %q", msgs[1].Meta)
+	}
+}
+
+func TestHTTPInputUpstreamStreaming(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	next := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte(strings.Repeat("data: 2\n\n", 200)))
+	}))
+	defer upstream.Close()
+	var once sync.Once
+	release := func() { once.Do(func() { close(next) }) }
+	defer release()
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{Upstream: upstream.URL, BufferSize: 1024})
+
+	var mu sync.Mutex
+	var msgs []*Message
+	output := NewTestOutput(func(msg *Message) {
+		mu.Lock()
+		msgs = append(msgs, msg)
+		mu.Unlock()
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+	defer emitter.Close()
+
+	wg.Add(2)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + input.address + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	done := make(chan string)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		done <- line
+	}()
+	select {
+	case line := <-done:
+		if line != "data: 1\n" {
+			t.Errorf("Expected first event, got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Response should be streamed to the client while it is recorded")
+	}
+	release()
+	body, _ := ioutil.ReadAll(reader)
+	resp.Body.Close()
+	if len(body) != 1+len("data: 2\n\n")*200 {
+		t.Errorf("Expected whole response to be proxied, got %d bytes", len(body))
+	}
+	wg.Wait()
+
+	if _, ok := PayloadMetaField(msgs[1].Meta, "truncated"); !ok || len(msgs[1].Data) > 1024 {
+		t.Errorf("Expected recorded response capped at buffer size: %q %d", msgs[1].Meta, len(msgs[1].Data))
+	}
+	recorded, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msgs[1].Data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(recorded.Body); int64(len(body)) != recorded.ContentLength || !strings.HasPrefix(string(body), "data: 1\n\ndata: 2") {
+		t.Errorf("Expected truncated response to be consistent, Content-Length %d body %q", recorded.ContentLength, body)
+	}
+}
+
+// writeTestCert creates a certificate signed by parent (self-signed if parent is nil) and stores it as PEM files in dir
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"httpcopy test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+func TestHTTPInputTLS(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	dir := t.TempDir()
+	defer func(interval time.Duration) { tlsReloadInterval = interval }(tlsReloadInterval)
+	tlsReloadInterval = 0
+
+	ca, caKey, caFile, _ := writeTestCert(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeTestCert(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeTestCert(t, dir, "client", ca, caKey)
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{TLSCert: serverCert, TLSKey: serverKey, TLSClientCA: caFile})
+
+	var meta []byte
+	output := NewTestOutput(func(msg *Message) {
+		meta = msg.Meta
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+	defer emitter.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	keyPair, _ := tls.LoadX509KeyPair(clientCert, clientKey)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{keyPair}}}}
+
+	if _, err := http.Get("https://" + input.address + "/"); err == nil {
+		t.Error("Expected plain client without certificate to be rejected")
+	}
+
+	wg.Add(1)
+	resp, err := client.Get("https://" + input.address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	wg.Wait()
+
+	if v, _ := PayloadMetaField(meta, "tls"); v != "1" {
+		t.Errorf("Expected TLS to be noted in meta: %q", meta)
+	}
+	if v, _ := PayloadMetaField(meta, "tls-client"); v != "CN=client,O=httpcopy test" {
+		t.Errorf("Expected client subject in meta, got %q", v)
+	}
+
+	// certificate is replaced on disk and picked up by the next handshake
+	writeTestCert(t, dir, "server", ca, caKey)
+	time.Sleep(10 * time.Millisecond)
+	wg.Add(1)
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	resp, err = client.Get("https://" + input.address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	wg.Wait()
+
+	reloaded, _ := tls.LoadX509KeyPair(serverCert, serverKey)
+	if !bytes.Equal(resp.TLS.PeerCertificates[0].Raw, reloaded.Certificate[0]) {
+		t.Error("Expected reloaded server certificate to be served")
+	}
+}
+
+func TestHTTPInputHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, _, _ := writeTestCert(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeTestCert(t, dir, "127.0.0.1", ca, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	cleartext := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
+	defer cleartext.Close()
+	encrypted := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{TLSCert: serverCert, TLSKey: serverKey})
+	defer encrypted.Close()
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	h2 := new(http.Protocols)
+	h2.SetHTTP2(true)
+
+	for _, tt := range []struct {
+		input     *HTTPInput
+		url       string
+		transport *http.Transport
+		proto     string
+	}{
+		{cleartext, "http://" + cleartext.address, &http.Transport{Protocols: h2c}, "h2c"},
+		{encrypted, "https://" + encrypted.address, &http.Transport{Protocols: h2, TLSClientConfig: &tls.Config{RootCAs: roots}}, "h2"},
+	} {
+		resp, err := (&http.Client{Transport: tt.transport}).Post(tt.url+"/upload?id=1", "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Errorf("Expected %s response, got %s", tt.proto, resp.Proto)
+		}
+
+		msg, _ := tt.input.PluginRead()
+		if v, _ := PayloadMetaField(msg.Meta, "proto"); v != tt.proto {
+			t.Errorf("Expected proto=%s in meta: %q", tt.proto, msg.Meta)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg.Data)))
+		if err != nil || !bytes.HasPrefix(msg.Data, []byte("POST /upload?id=1 HTTP/1.1\r\n")) || req.ContentLength != 7 {
+			t.Errorf("Expected request recorded in HTTP/1.1 format: %q %v", msg.Data, err)
+		}
+	}
+}
+
+func TestHTTPInputUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "in.sock")
+	// socket left by a process which was killed
+	stale, _ := net.Listen("unix", path)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	input := NewHTTPInput("unix://"+path, &HTTPInputConfig{})
+	defer input.Close()
+	if input.String() != "HTTP input: unix://"+path {
+		t.Errorf("Unexpected name %q", input.String())
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, "unix", path)
+	}}}
+	resp, err := client.Get("http://sidecar/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	msg, _ := input.PluginRead()
+	if _, ok := PayloadMetaField(msg.Meta, "ip"); ok || !bytes.HasPrefix(msg.Data, []byte("GET /path HTTP/1.1\r\nHost: sidecar\r\n")) {
+		t.Errorf("Unexpected request recorded: %q %q", msg.Meta, msg.Data)
+	}
+}
+
+func TestHTTPInputOverflow(t *testing.T) {
+	msg := func(n int) *Message {
+		return &Message{Meta: PayloadHeader(RequestPayload, Uuid(), int64(n), -1), Data: []byte("GET / HTTP/1.1\r\n\r\n")}
+	}
+	timing := func(msg *Message) string {
+		return string(PayloadMeta(msg.Meta)[2])
+	}
+
+	tests := []struct {
+		config   HTTPInputConfig
+		expected []string
+		dropped  int64
+	}{
+		{HTTPInputConfig{QueueLen: 2, Overflow: OverflowDropNewest}, []string{"0", "1"}, 2},
+		{HTTPInputConfig{QueueLen: 2, Overflow: OverflowDropOldest}, []string{"2", "3"}, 2},
+		{HTTPInputConfig{QueueLen: 2, BlockTimeout: time.Millisecond}, []string{"0", "1"}, 2},
+		// proxied clients don't wait for the queue
+		{HTTPInputConfig{QueueLen: 2, Upstream: "http://127.0.0.1:1"}, []string{"0", "1"}, 2},
+		{HTTPInputConfig{QueueLen: 2, Overflow: OverflowSpill, SpillDir: t.TempDir()}, []string{"0", "1", "2", "3"}, 0},
+	}
+
+	for _, tt := range tests {
+		input := NewHTTPInput("127.0.0.1:0", &tt.config)
+		for n := 0; n < 4; n++ {
+			input.enqueue(msg(n))
+		}
+
+		for _, expected := range tt.expected {
+			read, _ := input.PluginRead()
+			if timing(read) != expected {
+				t.Errorf("%s: expected message %s, got %s", tt.config.Overflow, expected, timing(read))
+			}
+		}
+		if dropped := input.stats.Get("dropped").(*expvar.Int).Value(); dropped != tt.dropped {
+			t.Errorf("%s: expected %d dropped messages, got %d", tt.config.Overflow, tt.dropped, dropped)
+		}
+		if depth := input.queueDepth(); depth != 0 {
+			t.Errorf("%s: expected empty queue, got %d", tt.config.Overflow, depth)
+		}
+		input.Close()
+	}
+}
+
+func TestHTTPInputUpstreamStalledOutput(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	// nothing reads the queue
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{Upstream: upstream.URL, QueueLen: 1})
+	defer input.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, path := range []string{"/queued", "/dropped"} {
+		resp, err := client.Get("http://" + input.address + path)
+		if err != nil {
+			t.Fatal("Proxied request should not wait for stalled output:", err)
+		}
+		// the connection is reused, so the next request is handled once the previous one is recorded
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// response of the first request doesn't fit, the second request is dropped with its response
+	msg, _ := input.PluginRead()
+	if !IsRequestPayload(msg.Meta) || !bytes.HasPrefix(msg.Data, []byte("GET /queued ")) {
+		t.Errorf("Expected first request to be queued: %q", msg.Data)
+	}
+	if dropped := input.stats.Get("dropped").(*expvar.Int).Value(); dropped != 2 {
+		t.Errorf("Expected 2 dropped messages, got %d", dropped)
+	}
+}
+
+func TestHTTPInputSpillInFlight(t *testing.T) {
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{QueueLen: 1, Overflow: OverflowSpill, SpillDir: t.TempDir()})
+	for n := 0; n < 2; n++ {
+		input.enqueue(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), int64(n), -1), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+	}
+	// unspill holds the second message until there is room in memory
+	time.Sleep(20 * time.Millisecond)
+	if depth := input.queueDepth(); depth != 2 {
+		t.Errorf("Message held by unspill should be counted as spilled, got depth %d", depth)
+	}
+
+	input.PluginRead()
+	input.Close()
+	dropped := input.stats.Get("dropped")
+	if msg, err := input.PluginRead(); err == nil {
+		if dropped != nil && dropped.(*expvar.Int).Value() != 0 {
+			t.Errorf("Delivered message should not be counted as dropped: %q", msg.Meta)
+		}
+	} else if dropped == nil || dropped.(*expvar.Int).Value() != 1 {
+		t.Error("Message held by unspill on Close should be counted as dropped")
+	}
+}
+
+func TestHTTPInputClose(t *testing.T) {
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
+	if _, err := http.Get("http://" + input.address + "/queued"); err != nil {
+		t.Fatal(err)
+	}
+	input.Close()
+
+	if _, err := http.Get("http://" + input.address + "/"); err == nil {
+		t.Error("Closed input should not accept connections")
+	}
+	msg, err := input.PluginRead()
+	if err != nil || !bytes.Contains(msg.Data, []byte("/queued")) {
+		t.Errorf("Request queued before Close should be read, got %v %v", msg, err)
+	}
+	if _, err := input.PluginRead(); err != ErrorStopped {
+		t.Errorf("Expected ErrorStopped once the queue is empty, got %v", err)
+	}
+}
+
+func TestHTTPInputBodyLimit(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	var received []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer upstream.Close()
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{Upstream: upstream.URL, BufferSize: 1024})
+	rejecting := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{BufferSize: 1024, RejectOversize: true})
+
+	var msgs []*Message
+	output := NewTestOutput(func(msg *Message) {
+		if IsRequestPayload(msg.Meta) {
+			msgs = append(msgs, msg)
+			wg.Done()
+		}
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input, rejecting},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, rejecting, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+	defer emitter.Close()
+
+	small := strings.Repeat("a", 100)
+	large := strings.Repeat("b", 4096)
+
+	wg.Add(2)
+	for _, body := range []string{small, large} {
+		resp, err := http.Post("http://"+input.address+"/", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if string(received) != body {
+			t.Errorf("Expected upstream to receive whole body of %d bytes, got %d", len(body), len(received))
+		}
+	}
+	wg.Wait()
+
+	if _, ok := PayloadMetaField(msgs[0].Meta, "truncated"); ok || !bytes.HasSuffix(msgs[0].Data, []byte(small)) {
+		t.Errorf("Expected small body to be recorded as is: %q %q", msgs[0].Meta, msgs[0].Data)
+	}
+	if _, ok := PayloadMetaField(msgs[1].Meta, "truncated"); !ok || len(msgs[1].Data) > 1024 {
+		t.Errorf("Expected large body to be truncated: %q %d", msgs[1].Meta, len(msgs[1].Data))
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msgs[1].Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(req.Body); int64(len(body)) != req.ContentLength || strings.Trim(string(body), "b") != "" {
+		t.Errorf("Expected truncated request to be consistent, Content-Length %d body %d", req.ContentLength, len(body))
+	}
+
+	resp, err := http.Post("http://"+rejecting.address+"/", "text/plain", strings.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPInputOriginalClient(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	mirror := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{OriginalHost: true, MirrorHeaders: true})
+	proxied := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{OriginalHost: true, ProxyProtocol: true})
+
+	var mu sync.Mutex
+	var msgs []*Message
+	output := NewTestOutput(func(msg *Message) {
+		mu.Lock()
+		msgs = append(msgs, msg)
+		mu.Unlock()
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{mirror, proxied},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, mirror, proxied, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+	defer emitter.Close()
+
+	send := func(address string, raw string) {
+		wg.Add(1)
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(raw))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		wg.Wait()
+	}
+	check := func(ip, host, uri string) {
+		mu.Lock()
+		msg := msgs[len(msgs)-1]
+		mu.Unlock()
+		if v, _ := PayloadMetaField(msg.Meta, "ip"); v != ip {
+			t.Errorf("Expected client ip %q, got %q", ip, v)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg.Data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Host != host || req.RequestURI != uri {
+			t.Errorf("Expected %s%s, got %s%s", host, uri, req.Host, req.RequestURI)
+		}
+		if req.Header.Get("X-Original-URI") != "" {
+			t.Errorf("Mirror headers should not be recorded: %q", msg.Data)
+		}
+	}
+
+	send(mirror.address, "GET /mirror HTTP/1.1\r\nHost: httpcopy\r\nX-Original-URI: /api/users?id=1\r\nX-Forwarded-For: 10.0.0.1, 10.0.0.2\r\nX-Forwarded-Host: api.example.com\r\n\r\n")
+	check("10.0.0.1", "api.example.com", "/api/users?id=1")
+
+	send(mirror.address, "GET /api HTTP/1.1\r\nHost: api.example.com-shadow:8080\r\n\r\n")
+	check("127.0.0.1", "api.example.com:8080", "/api")
+
+	send(proxied.address, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\nHost: v1.example.com\r\n\r\n")
+	check("192.168.0.1", "v1.example.com", "/")
+
+	v2 := append([]byte{}, proxyProtocolV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 172, 16, 0, 5, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb)
+	send(proxied.address, string(v2)+"GET / HTTP/1.1\r\nHost: v2.example.com\r\n\r\n")
+	check("172.16.0.5", "v2.example.com", "/")
+
+	conn, err := net.Dial("tcp", proxied.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+		t.Error("Expected connection without PROXY header to be refused")
+	}
+}
+
+func TestHTTPInputResponses(t *testing.T) {
+	config := &HTTPInputConfig{}
+	for _, v := range []string{`/:202:accepted`, `/webhook:200:{"id":"{{.ID}}","event":"{{.Header.Get "X-Event"}}"}`, `/webhook/ping:204`} {
+		if err := config.Responses.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{"/:Cache-Control: no-store", "/:Content-Type: text/plain", "/webhook:Content-Type: application/json"} {
+		if err := config.ResponseHeaders.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{"webhook:200", "/webhook", "/webhook:99", "/ping:204:pong", "/:200:{{.Missing"} {
+		if err := new(HTTPInputResponses).Set(v); err == nil {
+			t.Errorf("Expected %q to be rejected", v)
+		}
+	}
+	input := NewHTTPInput("127.0.0.1:0", config)
+	defer input.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/other", 202, "text/plain", "accepted"},
+		{"/webhook/github", 200, "application/json", `{"id":"%s","event":"push"}`},
+		{"/webhook/ping", 204, "application/json", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+input.address+tt.path, strings.NewReader("{}"))
+		req.Header.Set("X-Event", "push")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		msg, _ := input.PluginRead()
+
+		expected := tt.body
+		if strings.Contains(expected, "%s") {
+			expected = fmt.Sprintf(expected, PayloadID(msg.Meta))
+		}
+		if resp.StatusCode != tt.status || string(body) != expected {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.path, tt.status, expected, resp.StatusCode, body)
+		}
+		if resp.Header.Get("Content-Type") != tt.contentType || resp.Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: expected configured headers, got %v", tt.path, resp.Header)
+		}
+	}
+}
+
+func TestHTTPInputRespondAfterQueue(t *testing.T) {
+	for _, after := range []bool{false, true} {
+		input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{QueueLen: 1, Overflow: OverflowDropNewest, RespondAfterQueue: after})
+
+		var statuses []int
+		for n := 0; n < 2; n++ {
+			resp, err := http.Get("http://" + input.address + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			statuses = append(statuses, resp.StatusCode)
+		}
+		expected := []int{200, 200}
+		if after {
+			expected = []int{200, 503}
+		}
+		if !reflect.DeepEqual(statuses, expected) {
+			t.Errorf("respond after queue %v: expected %v, got %v", after, expected, statuses)
+		}
+		input.Close()
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Limiter is a wrapper for input or output plugin which adds rate limiting
 type Limiter struct {
 	plugin    interface{}
+	mu        sync.Mutex // limit may be changed on reload while plugin is read
 	limit     int
 	isPercent bool
 
@@ -35,19 +37,34 @@ func parseLimitOptions(options string) (limit int, isPercent bool) {
 // `options` allow to sprcify relatve or absolute limiting
 func NewLimiter(plugin interface{}, options string) PluginReadWriter {
 	l := new(Limiter)
-	l.limit, l.isPercent = parseLimitOptions(options)
 	l.plugin = plugin
+	l.setLimit(options)
+	return l
+}
+
+// setLimit changes the limit, empty options remove it
+func (l *Limiter) setLimit(options string) {
+	if options == "" {
+		options = "100%"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.isPercent = parseLimitOptions(options)
+	l.currentRPS = 0
 	l.currentTime = time.Now().UnixNano()
 
 	// FileInput have its own rate limiting. Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
-	if fi, ok := l.plugin.(*FileInput); ok && l.isPercent {
-		fi.SpeedFactor = float64(l.limit) / float64(100)
+	if fi, ok := l.plugin.(*FileInput); ok {
+		fi.SpeedFactor = 1
+		if l.isPercent {
+			fi.SpeedFactor = float64(l.limit) / float64(100)
+		}
 	}
-
-	return l
 }
 
 func (l *Limiter) isLimited() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	// File input have its own limiting algorithm
 	if _, ok := l.plugin.(*FileInput); ok && l.isPercent {
 		return false
@@ -100,6 +117,8 @@ func (l *Limiter) PluginRead() (msg *Message, err error) {
 }
 
 func (l *Limiter) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, l.limit, l.isPercent)
 }
 
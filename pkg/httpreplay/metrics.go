@@ -0,0 +1,213 @@
+package httpreplay
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types of the Prometheus text format
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// latencyBuckets are upper bounds of latency histograms, in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics is the registry of all plugins, exposed in Prometheus text format by MetricsHandler.
+// Most series read counters plugins already keep in expvar, so both show the same numbers.
+var metrics = &metricsRegistry{families: make(map[string]*metricFamily)}
+
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*metricSeries // by formatted labels
+}
+
+// metricSeries is a single time series, its value is either kept here or read from fn on scrape
+type metricSeries struct {
+	mu     sync.Mutex
+	labels string
+	value  float64
+	fn     func() float64
+	counts []uint64 // histogram only, per bucket and not cumulative
+	sum    float64
+}
+
+// series returns series of the family with given label pairs, e.g. series(..., "plugin", "HTTP input: :80"),
+// creating the family and the series if needed
+func (r *metricsRegistry) series(name, help, kind string, labels ...string) *metricSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f := r.families[name]
+	if f == nil {
+		f = &metricFamily{name: name, help: help, kind: kind, series: make(map[string]*metricSeries)}
+		if kind == metricHistogram {
+			f.buckets = latencyBuckets
+		}
+		r.families[name] = f
+	}
+
+	key := formatLabels(labels)
+	s := f.series[key]
+	if s == nil {
+		s = &metricSeries{labels: key}
+		if kind == metricHistogram {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter returns counter series
+func (r *metricsRegistry) Counter(name, help string, labels ...string) *metricSeries {
+	return r.series(name, help, metricCounter, labels...)
+}
+
+// CounterFunc registers counter read from fn, replacing the previous fn of the series
+func (r *metricsRegistry) CounterFunc(name, help string, fn func() float64, labels ...string) {
+	r.series(name, help, metricCounter, labels...).setFunc(fn)
+}
+
+// GaugeFunc registers gauge read from fn, replacing the previous fn of the series
+func (r *metricsRegistry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	r.series(name, help, metricGauge, labels...).setFunc(fn)
+}
+
+// Histogram returns histogram series with latencyBuckets
+func (r *metricsRegistry) Histogram(name, help string, labels ...string) *metricSeries {
+	return r.series(name, help, metricHistogram, labels...)
+}
+
+func (s *metricSeries) setFunc(fn func() float64) {
+	s.mu.Lock()
+	s.fn = fn
+	s.mu.Unlock()
+}
+
+// Add increments counter
+func (s *metricSeries) Add(delta float64) {
+	s.mu.Lock()
+	s.value += delta
+	s.mu.Unlock()
+}
+
+// Observe adds value to histogram
+func (s *metricSeries) Observe(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	s.counts[i]++
+	s.sum += v
+}
+
+// WriteTo writes all series in Prometheus text format
+func (r *metricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*metricFamily, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		r.mu.Lock()
+		series := make([]*metricSeries, 0, len(f.series))
+		for _, s := range f.series {
+			series = append(series, s)
+		}
+		r.mu.Unlock()
+		sort.Slice(series, func(i, j int) bool { return series[i].labels < series[j].labels })
+
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range series {
+			s.write(&b, f)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (s *metricSeries) write(b *strings.Builder, f *metricFamily) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f.kind != metricHistogram {
+		value := s.value
+		if s.fn != nil {
+			value = s.fn()
+		}
+		fmt.Fprintf(b, "%s%s %s\n", f.name, braces(s.labels), formatFloat(value))
+		return
+	}
+
+	var count uint64
+	for i := range s.counts {
+		bound := math.Inf(1)
+		if i < len(f.buckets) {
+			bound = f.buckets[i]
+		}
+		count += s.counts[i]
+		le := `le="` + formatFloat(bound) + `"`
+		if s.labels != "" {
+			le = s.labels + "," + le
+		}
+		fmt.Fprintf(b, "%s_bucket{%s} %d\n", f.name, le, count)
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", f.name, braces(s.labels), formatFloat(s.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", f.name, braces(s.labels), count)
+}
+
+// MetricsHandler serves metrics of all plugins in Prometheus text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteTo(w)
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label pairs as `a="1",b="2"`
+func formatLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,82 @@
+package httpreplay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	metrics.Counter("test_requests_total", "Test counter.", "target", `a "b"`).Add(2)
+	metrics.GaugeFunc("test_queue_depth", "Test gauge.", func() float64 { return 7 })
+	latency := metrics.Histogram("test_latency_seconds", "Test histogram.", "target", "a")
+	latency.Observe(0.003)
+	latency.Observe(0.2)
+	latency.Observe(30)
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{target="a \"b\""} 2`,
+		"# TYPE test_queue_depth gauge",
+		"test_queue_depth 7",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{target="a",le="0.005"} 1`,
+		`test_latency_seconds_bucket{target="a",le="0.25"} 2`,
+		`test_latency_seconds_bucket{target="a",le="10"} 2`,
+		`test_latency_seconds_bucket{target="a",le="+Inf"} 3`,
+		`test_latency_seconds_sum{target="a"} 30.203`,
+		`test_latency_seconds_count{target="a"} 3`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsHTTPOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	input := NewTestInput()
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{})
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	emitter.Start(plugins)
+	input.EmitGET()
+	emitter.Close()
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	target := `target="` + server.URL + `"`
+	for _, line := range []string{
+		`httpcopy_http_output_responses_total{` + target + `,code="418"} 1`,
+		`httpcopy_plugin_queue_depth{plugin="HTTP output: ` + server.URL + `"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, body)
+		}
+	}
+	for _, prefix := range []string{
+		`httpcopy_http_output_workers{` + target + `} `,
+		`httpcopy_http_output_latency_seconds_count{` + target + `} `,
+		`httpcopy_plugin_messages_total{plugin="HTTP output: ` + server.URL + `",direction="written"} `,
+	} {
+		if !strings.Contains(body, prefix) {
+			t.Errorf("Expected %q in:\n%s", prefix, body)
+		}
+	}
+}
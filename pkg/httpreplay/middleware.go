@@ -0,0 +1,188 @@
+package httpreplay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Middleware represents a middleware object
+// It's compatible with gor --middleware: every message is written to process stdin as a line
+// of hex encoded meta and data, and lines the process writes to stdout are read back as messages.
+// A message is dropped if the process doesn't write it back.
+type Middleware struct {
+	command       string
+	data          chan *Message
+	Stdin         io.Writer
+	Stdout        io.Reader
+	commandCancel context.CancelFunc
+	stop          chan bool // Channel used only to indicate goroutine should shutdown
+	closed        bool
+	mu            sync.RWMutex
+	writeMu       sync.Mutex     // messages from several inputs are written to stdin
+	copying       sync.WaitGroup // goroutines writing messages of inputs to stdin
+	readDone      chan struct{}  // closed once stdout is read to the end
+}
+
+// NewMiddleware returns new middleware
+func NewMiddleware(command string) *Middleware {
+	m := new(Middleware)
+	m.command = command
+	m.data = make(chan *Message, 1000)
+	m.stop = make(chan bool)
+	m.readDone = make(chan struct{})
+
+	commands := strings.Fields(command)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.commandCancel = cancel
+	cmd := exec.CommandContext(ctx, commands[0], commands[1:]...)
+
+	m.Stdout, _ = cmd.StdoutPipe()
+	m.Stdin, _ = cmd.StdinPipe()
+
+	cmd.Stderr = os.Stderr
+
+	go m.read(m.Stdout)
+
+	go func() {
+		defer m.Close()
+		var err error
+		if err = cmd.Start(); err == nil {
+			// Wait closes stdout, messages the process wrote before exiting must be read first
+			<-m.readDone
+			err = cmd.Wait()
+		}
+		if err != nil {
+			if e, ok := err.(*exec.ExitError); ok {
+				status := e.Sys().(syscall.WaitStatus)
+				if status.Signal() == syscall.SIGKILL /*killed or context canceled */ {
+					return
+				}
+			}
+			Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] error: %q", command, err.Error()))
+		}
+	}()
+
+	return m
+}
+
+// ReadFrom start a worker to read from this plugin
+func (m *Middleware) ReadFrom(plugin PluginReader) {
+	Debug(2, fmt.Sprintf("[MIDDLEWARE] command[%q] Starting reading from %q", m.command, plugin))
+	m.copying.Add(1)
+	go m.copy(m.Stdin, plugin)
+}
+
+func (m *Middleware) copy(to io.Writer, from PluginReader) {
+	defer m.copying.Done()
+	var dst []byte
+
+	for {
+		msg, err := from.PluginRead()
+		if err != nil {
+			return
+		}
+		if msg == nil || len(msg.Data) == 0 {
+			continue
+		}
+		dstLen := (len(msg.Data)+len(msg.Meta))*2 + 1
+		// if enough space was previously allocated use it instead
+		if dstLen > len(dst) {
+			dst = make([]byte, dstLen)
+		}
+		n := hex.Encode(dst, msg.Meta)
+		n += hex.Encode(dst[n:], msg.Data)
+		dst[n] = '\n'
+
+		m.writeMu.Lock()
+		_, err = to.Write(dst[:n+1])
+		m.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *Middleware) read(from io.Reader) {
+	defer close(m.readDone)
+	reader := bufio.NewReader(from)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		buf := make([]byte, len(line)/2)
+		if _, err := hex.Decode(buf, line); err != nil {
+			Debug(0, fmt.Sprintf("[MIDDLEWARE] command[%q] failed to decode err: %q", m.command, err))
+			continue
+		}
+		var msg Message
+		msg.Meta, msg.Data = PayloadMetaWithBody(buf)
+		select {
+		case <-m.stop:
+			return
+		case m.data <- &msg:
+		}
+	}
+}
+
+// PluginRead reads message from this plugin
+func (m *Middleware) PluginRead() (msg *Message, err error) {
+	select {
+	case <-m.stop:
+		// messages the process wrote before exiting are still delivered
+		select {
+		case msg = <-m.data:
+		default:
+			return nil, ErrorStopped
+		}
+	case msg = <-m.data:
+	}
+	return
+}
+
+func (m *Middleware) String() string {
+	return fmt.Sprintf("Modifying traffic using %q command", m.command)
+}
+
+// IsClosed returns if the middleware process was stopped
+func (m *Middleware) IsClosed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.closed
+}
+
+// CloseInput waits until messages read from inputs are written to the process, then closes its stdin,
+// so that the process writes out the rest of the messages and exits. Inputs must be closed first.
+func (m *Middleware) CloseInput(deadline time.Time) bool {
+	done := waitUntil(&m.copying, deadline)
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if c, ok := m.Stdin.(io.Closer); ok {
+		c.Close()
+	}
+	return done
+}
+
+// Close closes this plugin
+func (m *Middleware) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.commandCancel()
+	close(m.stop)
+	m.closed = true
+	return nil
+}
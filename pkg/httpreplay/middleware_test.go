@@ -0,0 +1,97 @@
+package httpreplay
+
+import (
+	"bytes"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareEarlyClose(t *testing.T) {
+	m := NewMiddleware("cat")
+	time.Sleep(10 * time.Millisecond)
+	m.Close()
+	if _, err := m.PluginRead(); err != ErrorStopped {
+		t.Errorf("Expected closed middleware to stop reading, got %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	if _, err := exec.LookPath("grep"); err != nil {
+		t.Skip("grep is not available")
+	}
+	defer func(cmd string) { Settings.Middleware = cmd }(Settings.Middleware)
+	// drops messages containing "/drop", hex encoded
+	Settings.Middleware = "grep --line-buffered -v 2f64726f70"
+
+	wg := new(sync.WaitGroup)
+	input := NewTestInput()
+	var mu sync.Mutex
+	var received []*Message
+	output := NewTestOutput(func(msg *Message) {
+		mu.Lock()
+		received = append(received, msg)
+		mu.Unlock()
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+
+	wg.Add(2)
+	input.EmitPOST()
+	input.EmitBytes([]byte("GET /drop HTTP/1.1\r\n\r\n"))
+	input.EmitGET()
+	wg.Wait()
+	emitter.Close()
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(received))
+	}
+	if !bytes.Equal(received[0].Data, []byte("POST /pub/WWW/ HTTP/1.1\r\nContent-Length: 7\r\nHost: www.w3.org\r\n\r\na=1&b=2")) {
+		t.Errorf("Message should pass middleware unchanged: %q", received[0].Data)
+	}
+	if !IsRequestPayload(received[1].Meta) || !bytes.Equal(received[1].Data, []byte("GET / HTTP/1.1\r\n\r\n")) {
+		t.Errorf("Expected dropped message to be skipped: %q", received[1].Data)
+	}
+}
+
+func TestMiddlewareCloseDrains(t *testing.T) {
+	if _, err := exec.LookPath("grep"); err != nil {
+		t.Skip("grep is not available")
+	}
+	defer func(cmd string) { Settings.Middleware = cmd }(Settings.Middleware)
+	// without --line-buffered output is written once stdin is closed
+	Settings.Middleware = "grep -v 2f64726f70"
+
+	input := NewTestInput()
+	var received int32
+	output := NewTestOutput(func(msg *Message) {
+		atomic.AddInt32(&received, 1)
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	emitter.Start(plugins)
+
+	input.EmitPOST()
+	input.EmitGET()
+	emitter.Close()
+
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Errorf("Messages passed to middleware should reach outputs on close, got %d", n)
+	}
+}
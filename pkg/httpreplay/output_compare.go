@@ -0,0 +1,379 @@
+package httpreplay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpcopy/pkg/proto"
+)
+
+// CompareOutputConfig holds configuration of the response comparator
+type CompareOutputConfig struct {
+	Headers []string      `json:"output-compare-header"`
+	Ignore  []string      `json:"output-compare-ignore"`
+	Timeout time.Duration `json:"output-compare-timeout"`
+}
+
+// CompareOutput joins original responses recorded by inputs with responses replayed by
+// --output-http-track-response, and writes a JSON line to the report for every pair that differs.
+// Status codes, configured headers and bodies are compared, JSON bodies are compared
+// value by value so that key order and formatting don't matter.
+type CompareOutput struct {
+	mu      sync.Mutex
+	path    string
+	config  *CompareOutputConfig
+	ignore  [][]string
+	file    *os.File
+	writer  *bufio.Writer
+	pending map[string]*comparePair
+	stats   *expvar.Map
+	stop    chan bool
+	closed  bool
+}
+
+type comparePair struct {
+	request  string
+	original *Message
+	replayed *Message
+	seen     time.Time
+}
+
+// compareMismatch is a single line of the report, only fields that differ are set
+type compareMismatch struct {
+	ID      string               `json:"id"`
+	Request string               `json:"request,omitempty"`
+	Status  []int                `json:"status,omitempty"`
+	GRPC    []string             `json:"grpc_status,omitempty"`
+	Headers map[string][2]string `json:"headers,omitempty"`
+	Body    []string             `json:"body,omitempty"`
+}
+
+// NewCompareOutput creates comparator writing mismatches to the report file at path
+func NewCompareOutput(path string, config *CompareOutputConfig) *CompareOutput {
+	o := new(CompareOutput)
+	o.path = path
+	o.config = config
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = time.Minute
+	}
+	for _, p := range config.Ignore {
+		o.ignore = append(o.ignore, strings.Split(strings.TrimPrefix(p, "$."), "."))
+	}
+
+	var err error
+	if o.file, err = os.Create(path); err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-COMPARE] cannot create report %q: %q", path, err))
+	}
+	o.writer = bufio.NewWriter(o.file)
+	o.pending = make(map[string]*comparePair)
+	o.stats = expvarMap("output-compare-" + path)
+	for _, result := range []string{"matched", "mismatched", "missing-original", "missing-replayed"} {
+		result := result
+		metrics.CounterFunc("httpcopy_compare_responses_total", "Response pairs compared by the comparator.", func() float64 {
+			return float64(expvarInt(o.stats, result))
+		}, "report", path, "result", result)
+	}
+	o.stop = make(chan bool)
+
+	go o.expire()
+
+	return o
+}
+
+// PluginWrite collects requests, original and replayed responses until the pair can be compared
+func (o *CompareOutput) PluginWrite(msg *Message) (n int, err error) {
+	n = len(msg.Meta) + len(msg.Data)
+	meta := PayloadMeta(msg.Meta)
+	if len(meta) < 3 {
+		return n, nil
+	}
+	id := string(meta[1])
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, ErrorStopped
+	}
+
+	pair := o.pending[id]
+	if pair == nil {
+		pair = &comparePair{seen: time.Now()}
+		o.pending[id] = pair
+	}
+	switch meta[0][0] {
+	case RequestPayload:
+		pair.request = fmt.Sprintf("%s %s", proto.Method(msg.Data), proto.Path(msg.Data))
+	case ResponsePayload:
+		pair.original = msg
+	case ReplayedResponsePayload:
+		pair.replayed = msg
+	}
+
+	if pair.original != nil && pair.replayed != nil {
+		delete(o.pending, id)
+		o.compare(id, pair)
+	}
+	return n, nil
+}
+
+func (o *CompareOutput) compare(id string, pair *comparePair) {
+	o.stats.Add("compared", 1)
+
+	mismatch := compareMismatch{ID: id, Request: pair.request}
+	original, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(pair.original.Data)), nil)
+	if err != nil {
+		o.stats.Add("malformed", 1)
+		Debug(1, fmt.Sprintf("[OUTPUT-COMPARE] original response %s: %q", id, err))
+		return
+	}
+	replayed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(pair.replayed.Data)), nil)
+	if err != nil {
+		o.stats.Add("malformed", 1)
+		Debug(1, fmt.Sprintf("[OUTPUT-COMPARE] replayed response %s: %q", id, err))
+		return
+	}
+
+	if original.StatusCode != replayed.StatusCode {
+		mismatch.Status = []int{original.StatusCode, replayed.StatusCode}
+		o.stats.Add("status", 1)
+	}
+
+	for _, name := range o.config.Headers {
+		a, b := strings.Join(original.Header.Values(name), ", "), strings.Join(replayed.Header.Values(name), ", ")
+		if a != b {
+			if mismatch.Headers == nil {
+				mismatch.Headers = make(map[string][2]string)
+			}
+			mismatch.Headers[http.CanonicalHeaderKey(name)] = [2]string{a, b}
+		}
+	}
+	if mismatch.Headers != nil {
+		o.stats.Add("headers", 1)
+	}
+
+	// bodies cut by --copy-buffer-size can't be compared
+	_, truncatedOriginal := PayloadMetaField(pair.original.Meta, "truncated")
+	_, truncatedReplayed := PayloadMetaField(pair.replayed.Meta, "truncated")
+	if truncatedOriginal || truncatedReplayed {
+		o.stats.Add("truncated", 1)
+	} else if mismatch.Body = o.diffBody(original, replayed); mismatch.Body != nil {
+		o.stats.Add("body", 1)
+	}
+
+	// grpc-status comes in trailers, which are read with the body
+	if a, b := grpcStatus(original), grpcStatus(replayed); a != b {
+		mismatch.GRPC = []string{a, b}
+		o.stats.Add("grpc_status", 1)
+	}
+
+	if mismatch.Status == nil && mismatch.GRPC == nil && mismatch.Headers == nil && mismatch.Body == nil {
+		o.stats.Add("matched", 1)
+		return
+	}
+	o.stats.Add("mismatched", 1)
+
+	line, _ := json.Marshal(mismatch)
+	o.writer.Write(line)
+	o.writer.WriteByte('\n')
+}
+
+// diffBody returns paths of JSON values which differ, or "$" if bodies differ as a whole
+func (o *CompareOutput) diffBody(original, replayed *http.Response) []string {
+	a, errA := readBody(original)
+	b, errB := readBody(replayed)
+	if errA != nil || errB != nil {
+		// incomplete bodies are compared as they are
+		Debug(2, fmt.Sprintf("[OUTPUT-COMPARE] read body: %v %v", errA, errB))
+	}
+
+	var jsonA, jsonB interface{}
+	if decodeJSON(a, &jsonA) == nil && decodeJSON(b, &jsonB) == nil {
+		var diff []string
+		o.diffJSON(nil, jsonA, jsonB, &diff)
+		return diff
+	}
+	if !bytes.Equal(a, b) {
+		return []string{"$"}
+	}
+	return nil
+}
+
+// diffJSON walks both values and appends paths of differences, e.g. "$.items.0.id"
+func (o *CompareOutput) diffJSON(path []string, a, b interface{}, diff *[]string) {
+	if o.ignored(path) {
+		return
+	}
+
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(a)+len(b))
+			for k := range a {
+				keys = append(keys, k)
+			}
+			for k := range b {
+				if _, ok := a[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				var valueA, valueB interface{} = jsonMissing{}, jsonMissing{}
+				if v, ok := a[k]; ok {
+					valueA = v
+				}
+				if v, ok := b[k]; ok {
+					valueB = v
+				}
+				o.diffJSON(append(path[:len(path):len(path)], k), valueA, valueB, diff)
+			}
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			for i := 0; i < len(a) || i < len(b); i++ {
+				var itemA, itemB interface{} = jsonMissing{}, jsonMissing{}
+				if i < len(a) {
+					itemA = a[i]
+				}
+				if i < len(b) {
+					itemB = b[i]
+				}
+				o.diffJSON(append(path[:len(path):len(path)], strconv.Itoa(i)), itemA, itemB, diff)
+			}
+			return
+		}
+	default:
+		if a == b {
+			return
+		}
+	}
+	*diff = append(*diff, strings.Join(append([]string{"$"}, path...), "."))
+}
+
+// jsonMissing marks key or array item which exists only in one of the bodies
+type jsonMissing struct{}
+
+// ignored reports whether path matches one of --output-compare-ignore paths, "*" matches any key or index
+func (o *CompareOutput) ignored(path []string) bool {
+	for _, ignore := range o.ignore {
+		if len(ignore) != len(path) {
+			continue
+		}
+		matched := true
+		for i := range ignore {
+			if ignore[i] != "*" && ignore[i] != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func readBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.Header.Get("Content-Encoding") != "gzip" {
+		return body, err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body, err
+	}
+	return io.ReadAll(reader)
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// numbers are compared as written, float64 would hide differences in large ids
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// expire drops pairs which didn't get both responses in time
+func (o *CompareOutput) expire() {
+	ticker := time.NewTicker(o.config.Timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-ticker.C:
+		}
+
+		o.mu.Lock()
+		o.expirePending(time.Now().Add(-o.config.Timeout))
+		o.writer.Flush()
+		o.mu.Unlock()
+	}
+}
+
+func (o *CompareOutput) expirePending(before time.Time) {
+	for id, pair := range o.pending {
+		if !pair.seen.Before(before) {
+			continue
+		}
+		delete(o.pending, id)
+		switch {
+		case pair.original != nil:
+			o.stats.Add("missing-replayed", 1)
+		case pair.replayed != nil:
+			o.stats.Add("missing-original", 1)
+		}
+	}
+}
+
+// Summary returns counters of compared responses
+func (o *CompareOutput) Summary() map[string]int64 {
+	return expvarSummary(o.stats)
+}
+
+func (o *CompareOutput) String() string {
+	return "Compare output: " + o.path
+}
+
+// Close counts unmatched pairs as missing, writes summary as the last report line and closes the report
+func (o *CompareOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	close(o.stop)
+
+	o.expirePending(time.Now().Add(time.Hour))
+	summary := o.Summary()
+	line, _ := json.Marshal(map[string]interface{}{"summary": summary})
+	o.writer.Write(line)
+	o.writer.WriteByte('\n')
+
+	if err := o.writer.Flush(); err != nil {
+		o.file.Close()
+		return err
+	}
+	return o.file.Close()
+}
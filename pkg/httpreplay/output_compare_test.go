@@ -0,0 +1,144 @@
+package httpreplay
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func readCompareReport(t *testing.T, path string) (mismatches []compareMismatch, summary map[string]int64) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line struct {
+			compareMismatch
+			Summary map[string]int64 `json:"summary"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Summary != nil {
+			summary = line.Summary
+			continue
+		}
+		mismatches = append(mismatches, line.compareMismatch)
+	}
+	return
+}
+
+func TestCompareOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.jsonl")
+	output := NewCompareOutput(path, &CompareOutputConfig{
+		Headers: []string{"content-type"},
+		Ignore:  []string{"updated_at", "items.*.id"},
+	})
+
+	write := func(meta, data string) {
+		output.PluginWrite(&Message{Meta: []byte(meta + "\n"), Data: []byte(data)})
+	}
+	jsonHeader := "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n"
+	response := func(header, body string) string {
+		return fmt.Sprintf(header, len(body)) + body
+	}
+
+	// same JSON with different formatting and ignored values
+	write("1 a 1 -1", "GET /a HTTP/1.1\r\n\r\n")
+	write("2 a 2 1", response(jsonHeader, `{"ok":true,"updated_at":1,"items":[{"id":1,"n":"x"}]}`))
+	write("3 a 3 1", response(jsonHeader, `{"items": [{"n": "x", "id": 2}], "updated_at": 2, "ok": true}`))
+
+	// different status, header and body
+	write("1 b 1 -1", "POST /b?x=1 HTTP/1.1\r\n\r\n")
+	write("3 b 3 1", response("HTTP/1.1 500 Internal Server Error\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n", "oops"))
+	write("2 b 2 1", response(jsonHeader, `{"ok":true}`))
+
+	// JSON values at different paths
+	write("2 c 2 1", response(jsonHeader, `{"user":{"id":1,"name":"a"},"tags":["x"]}`))
+	write("3 c 3 1", response(jsonHeader, `{"user":{"id":1,"name":"b"},"tags":["x","y"],"new":null}`))
+
+	// original response without replayed one
+	write("2 d 2 1", response(jsonHeader, `{}`))
+
+	output.Close()
+
+	mismatches, summary := readCompareReport(t, path)
+	expected := []compareMismatch{
+		{
+			ID:      "b",
+			Request: "POST /b?x=1",
+			Status:  []int{200, 500},
+			Headers: map[string][2]string{"Content-Type": {"application/json", "text/plain"}},
+			Body:    []string{"$"},
+		},
+		{ID: "c", Body: []string{"$.new", "$.tags.1", "$.user.name"}},
+	}
+	if !reflect.DeepEqual(mismatches, expected) {
+		t.Errorf("Expected mismatches %+v, got %+v", expected, mismatches)
+	}
+
+	expectedSummary := map[string]int64{"compared": 3, "matched": 1, "mismatched": 2, "status": 1, "headers": 1, "body": 2, "missing-replayed": 1}
+	if !reflect.DeepEqual(summary, expectedSummary) {
+		t.Errorf("Expected summary %v, got %v", expectedSummary, summary)
+	}
+	if v := expvar.Get("output-compare-" + path).(*expvar.Map).Get("mismatched").String(); v != "2" {
+		t.Errorf("Expected summary in expvar, got %s", v)
+	}
+}
+
+func TestCompareOutputReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"path":"` + r.URL.Path + `","version":2}`))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "report.jsonl")
+	input := NewTestInput()
+	input.skipHeader = true
+	httpOutput := NewHTTPOutput(server.URL, &HTTPOutputConfig{TrackResponses: true})
+	compare := NewCompareOutput(path, &CompareOutputConfig{})
+
+	wg := new(sync.WaitGroup)
+	done := NewTestOutput(func(msg *Message) {
+		if msg.Meta[0] == ReplayedResponsePayload {
+			wg.Done()
+		}
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input, httpOutput},
+		Outputs: []PluginWriter{httpOutput, compare, done},
+	}
+	plugins.All = append(plugins.All, input, httpOutput, compare, done)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins)
+
+	wg.Add(2)
+	original := "HTTP/1.1 200 OK\r\nContent-Length: 27\r\n\r\n{\"version\":2,\"path\":\"/a\"}\n"
+	input.EmitBytes([]byte("1 a 1 -1\nGET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	input.EmitBytes([]byte("2 a 1 1\n" + original))
+	input.EmitBytes([]byte("1 b 1 -1\nGET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	input.EmitBytes([]byte("2 b 1 1\nHTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\n{\"version\":1}"))
+	wg.Wait()
+	emitter.Close()
+
+	mismatches, summary := readCompareReport(t, path)
+	if len(mismatches) != 1 || mismatches[0].ID != "b" || !reflect.DeepEqual(mismatches[0].Body, []string{"$.path", "$.version"}) {
+		t.Errorf("Expected only b to differ, got %+v", mismatches)
+	}
+	if summary["compared"] != 2 || summary["matched"] != 1 {
+		t.Errorf("Expected 2 compared responses, got %v", summary)
+	}
+}
@@ -65,12 +65,15 @@ type FileOutput struct {
 	pathTemplate    string
 	currentName     string
 	File            *os.File
+	openName        string // currentName of the open File, which is in BufferPath if configured
 	QueueLength     int
 	writer          io.Writer
 	requestPerFile  bool
 	currentID       []byte
 	payloadType     []byte
 	closed          bool
+	reopen          bool // append to the file opened next instead of truncating it
+	maxSizeReached  bool
 	currentFileSize int
 	totalFileSize   size.Size
 
@@ -180,6 +183,13 @@ func (o *FileOutput) filename() string {
 		withoutExt := strings.TrimSuffix(path, ext)
 
 		if matches, err := filepath.Glob(withoutExt + "*" + ext); err == nil {
+			if o.config.BufferPath != "" {
+				// the open chunk is not moved next to completed ones yet
+				buffered, _ := filepath.Glob(filepath.Join(o.config.BufferPath, filepath.Base(withoutExt)+"*"+ext))
+				for _, name := range buffered {
+					matches = append(matches, filepath.Join(filepath.Dir(path), filepath.Base(name)))
+				}
+			}
 			if len(matches) == 0 {
 				return setFileIndex(path, 0)
 			}
@@ -224,10 +234,32 @@ func (o *FileOutput) PluginWrite(msg *Message) (n int, err error) {
 	o.Lock()
 	defer o.Unlock()
 
-	if o.File == nil || o.currentName != o.File.Name() {
+	if o.closed {
+		return 0, ErrorStopped
+	}
+
+	if o.config.OutputFileMaxSize > 0 && o.totalFileSize >= o.config.OutputFileMaxSize {
+		if !o.maxSizeReached {
+			o.maxSizeReached = true
+			Debug(0, fmt.Sprintf("[OUTPUT-FILE] --output-file-max-size-limit %d reached, dropping records", o.config.OutputFileMaxSize))
+		}
+		return len(msg.Data), nil
+	}
+
+	if o.File == nil || o.currentName != o.openName {
 		o.closeLocked()
 
-		o.File, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		o.openName = o.currentName
+		name := o.currentName
+		if o.config.BufferPath != "" {
+			name = filepath.Join(o.config.BufferPath, filepath.Base(o.currentName))
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if o.reopen || o.config.Append {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+			o.reopen = false
+		}
+		o.File, err = os.OpenFile(name, flags, 0660)
 		o.File.Sync()
 
 		if strings.HasSuffix(o.currentName, ".gz") {
@@ -285,33 +317,55 @@ func (o *FileOutput) flush() {
 }
 
 func (o *FileOutput) String() string {
-	return "File output: " + o.File.Name()
+	return "File output: " + o.pathTemplate
 }
 
 func (o *FileOutput) closeLocked() error {
 	if o.File != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
+		if strings.HasSuffix(o.File.Name(), ".gz") {
 			o.writer.(*gzip.Writer).Close()
 		} else {
 			o.writer.(*bufio.Writer).Flush()
 		}
 		o.File.Close()
 
+		name := o.File.Name()
+		if o.config.BufferPath != "" && o.openName != "" {
+			if err := os.Rename(name, o.openName); err != nil {
+				Debug(0, fmt.Sprintf("[OUTPUT-FILE] cannot move %q from --output-file-buffer: %q", name, err))
+			} else {
+				name = o.openName
+			}
+			o.openName = ""
+		}
+
 		if o.config.onClose != nil {
-			o.config.onClose(o.File.Name())
+			o.config.onClose(name)
 		}
+		o.File = nil
 	}
 
-	o.closed = true
 	o.currentFileSize = 0
 
 	return nil
 }
 
+// Reopen closes the file, the next record opens it again and appends to it.
+// Used on reload, so that files moved by logrotate are recreated.
+func (o *FileOutput) Reopen() error {
+	o.Lock()
+	defer o.Unlock()
+	if o.File != nil {
+		o.reopen = true
+	}
+	return o.closeLocked()
+}
+
 // Close closes the output file that is being written to.
 func (o *FileOutput) Close() error {
 	o.Lock()
 	defer o.Unlock()
+	o.closed = true
 	return o.closeLocked()
 }
 
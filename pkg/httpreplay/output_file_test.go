@@ -5,6 +5,7 @@ import (
 	"httpcopy/pkg/size"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"sync"
@@ -16,8 +17,9 @@ import (
 func TestFileOutput(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
+	name := filepath.Join(t.TempDir(), "test_requests.gor")
 	input := NewTestInput()
-	output := NewFileOutput("/tmp/test_requests.gor", &FileOutputConfig{FlushInterval: time.Minute, Append: true})
+	output := NewFileOutput(name, &FileOutputConfig{FlushInterval: time.Minute, Append: true})
 
 	plugins := &InOutPlugins{
 		Inputs:  []PluginReader{input},
@@ -38,7 +40,7 @@ func TestFileOutput(t *testing.T) {
 	emitter.Close()
 
 	var counter int64
-	input2 := NewFileInput("/tmp/test_requests.gor", false, 100, 0, false)
+	input2 := NewFileInput(name, false, 100, 0, false)
 	output2 := NewTestOutput(func(*Message) {
 		atomic.AddInt64(&counter, 1)
 		wg.Done()
@@ -329,3 +331,86 @@ func TestFileOutputAppendSizeLimitOverflow(t *testing.T) {
 	os.Remove(name1)
 	os.Remove(name3)
 }
+
+func TestFileOutputMaxSize(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d", rand.Int63())
+	output := NewFileOutput(name, &FileOutputConfig{Append: true, FlushInterval: time.Minute, OutputFileMaxSize: 30})
+
+	for i := 0; i < 5; i++ {
+		output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
+	}
+	output.Close()
+
+	s, _ := os.Stat(name)
+	// the limit is checked before each write, so the second record still fits
+	if expected := int64(2 * (11 + len(PayloadSeparator))); s.Size() != expected {
+		t.Errorf("Expected records after max size to be dropped, file size %d, expected %d", s.Size(), expected)
+	}
+
+	os.Remove(name)
+}
+
+func TestFileOutputBufferPath(t *testing.T) {
+	dir, buffer := t.TempDir(), t.TempDir()
+	name := dir + "/requests"
+
+	output := NewFileOutput(name, &FileOutputConfig{FlushInterval: time.Minute, QueueLimit: 1, BufferPath: buffer})
+
+	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
+	if output.File.Name() != buffer+"/requests_0" {
+		t.Error("Open chunk should be written to buffer path:", output.File.Name())
+	}
+
+	output.updateName()
+	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
+	if _, err := os.Stat(name + "_0"); err != nil {
+		t.Error("Completed chunk should be moved from buffer path:", err)
+	}
+
+	output.Close()
+	output.Close()
+	if _, err := os.Stat(name + "_1"); err != nil {
+		t.Error("Chunk should be moved on close:", err)
+	}
+	if matches, _ := filepath.Glob(buffer + "/*"); len(matches) != 0 {
+		t.Error("Buffer path should be empty:", matches)
+	}
+}
+
+func TestFileOutputAppend(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "requests.gor")
+	for i := 0; i < 2; i++ {
+		output := NewFileOutput(name, &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+		output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
+		output.Close()
+	}
+
+	record := int64(11 + len(PayloadSeparator))
+	if s, _ := os.Stat(name); s.Size() != 2*record {
+		t.Error("Existing file should be appended to, got size", s.Size())
+	}
+}
+
+func TestFileOutputReopen(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "requests.gor")
+	output := NewFileOutput(name, &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+	defer output.Close()
+
+	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
+	output.Reopen()
+	output.PluginWrite(&Message{Meta: []byte("1 2 1\r\n"), Data: []byte("test")})
+
+	// file moved by logrotate
+	os.Rename(name, name+".1")
+	output.Reopen()
+	output.PluginWrite(&Message{Meta: []byte("1 3 1\r\n"), Data: []byte("test")})
+	output.flush()
+
+	record := int64(11 + len(PayloadSeparator))
+	if s, _ := os.Stat(name + ".1"); s.Size() != 2*record {
+		t.Error("Reopened file should be appended to, got size", s.Size())
+	}
+	if s, _ := os.Stat(name); s.Size() != record {
+		t.Error("Moved file should be recreated, got size", s.Size())
+	}
+}
@@ -3,14 +3,22 @@ package httpreplay
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"expvar"
 	"fmt"
 	"httpcopy/pkg/size"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -26,6 +34,7 @@ type response struct {
 	uuid          []byte
 	startedAt     int64
 	roundTripTime int64
+	truncated     bool // payload was capped at --output-http-response-buffer
 }
 
 // HTTPOutputConfig struct for holding http output configuration
@@ -42,8 +51,41 @@ type HTTPOutputConfig struct {
 	WorkerTimeout  time.Duration `json:"output-http-worker-timeout"`
 	BufferSize     size.Size     `json:"output-http-response-buffer"`
 	SkipVerify     bool          `json:"output-http-skip-verify"`
-	rawURL         string
-	url            *url.URL
+
+	// TLSCert and TLSKey are the client certificate for mutual TLS, reloaded when the files change
+	TLSCert       string `json:"output-http-tls-cert"`
+	TLSKey        string `json:"output-http-tls-key"`
+	TLSCA         string `json:"output-http-tls-ca"`
+	TLSServerName string `json:"output-http-tls-server-name"`
+	// Proxy is http://, https:// or socks5:// URL of the outbound proxy, HTTP_PROXY environment is used by default
+	Proxy               string        `json:"output-http-proxy"`
+	MaxIdleConnsPerHost int           `json:"output-http-max-idle-conns-per-host"`
+	IdleConnTimeout     time.Duration `json:"output-http-idle-conn-timeout"`
+	DisableKeepAlives   bool          `json:"output-http-disable-keep-alive"`
+	DisableCompression  bool          `json:"output-http-disable-compression"`
+	// Protocol forces HTTP/1.1, HTTP/2 or h2c, see ProtocolHTTP1
+	Protocol string `json:"output-http-protocol"`
+	// SocketHost is the Host of requests to unix:// targets
+	SocketHost string `json:"output-http-socket-host"`
+	// RetryAttempts is the maximum number of attempts to send a request, 1 disables retries
+	RetryAttempts   int           `json:"output-http-retry-attempts"`
+	RetryBackoff    time.Duration `json:"output-http-retry-backoff"`
+	RetryMaxBackoff time.Duration `json:"output-http-retry-max-backoff"`
+	RetryOn         []string      `json:"output-http-retry-on"`
+	// DeadLetter is the file receiving requests which failed after all attempts
+	DeadLetter string `json:"output-http-dead-letter"`
+
+	// Adaptive limits workers by AIMD, see adaptiveLimit
+	Adaptive           bool          `json:"output-http-adaptive"`
+	AdaptiveLatency    time.Duration `json:"output-http-adaptive-latency"`
+	BreakerErrorRate   float64       `json:"output-http-breaker-error-rate"`
+	BreakerMinRequests int           `json:"output-http-breaker-min-requests"`
+	BreakerWindow      time.Duration `json:"output-http-breaker-window"`
+	BreakerCooldown    time.Duration `json:"output-http-breaker-cooldown"`
+
+	rawURL string
+	url    *url.URL
+	socket string // path of unix:// target
 }
 
 func (hoc *HTTPOutputConfig) Copy() *HTTPOutputConfig {
@@ -60,6 +102,31 @@ func (hoc *HTTPOutputConfig) Copy() *HTTPOutputConfig {
 		WorkerTimeout:  hoc.WorkerTimeout,
 		BufferSize:     hoc.BufferSize,
 		SkipVerify:     hoc.SkipVerify,
+
+		TLSCert:             hoc.TLSCert,
+		TLSKey:              hoc.TLSKey,
+		TLSCA:               hoc.TLSCA,
+		TLSServerName:       hoc.TLSServerName,
+		Proxy:               hoc.Proxy,
+		MaxIdleConnsPerHost: hoc.MaxIdleConnsPerHost,
+		IdleConnTimeout:     hoc.IdleConnTimeout,
+		DisableKeepAlives:   hoc.DisableKeepAlives,
+		DisableCompression:  hoc.DisableCompression,
+		Protocol:            hoc.Protocol,
+		SocketHost:          hoc.SocketHost,
+
+		RetryAttempts:   hoc.RetryAttempts,
+		RetryBackoff:    hoc.RetryBackoff,
+		RetryMaxBackoff: hoc.RetryMaxBackoff,
+		RetryOn:         append([]string{}, hoc.RetryOn...),
+		DeadLetter:      hoc.DeadLetter,
+
+		Adaptive:           hoc.Adaptive,
+		AdaptiveLatency:    hoc.AdaptiveLatency,
+		BreakerErrorRate:   hoc.BreakerErrorRate,
+		BreakerMinRequests: hoc.BreakerMinRequests,
+		BreakerWindow:      hoc.BreakerWindow,
+		BreakerCooldown:    hoc.BreakerCooldown,
 	}
 }
 
@@ -68,13 +135,26 @@ func (hoc *HTTPOutputConfig) Copy() *HTTPOutputConfig {
 // You can specify maximum number of workers using `--output-http-workers`
 type HTTPOutput struct {
 	activeWorkers int32
+	pending       int64 // requests queued or being sent
 	config        *HTTPOutputConfig
 	queueStats    *GorStat
+	rttStats      *GorStat
+	stats         *expvar.Map
+	latency       *metricSeries
+	retryOn       map[string]bool
+	deadLetter    *deadLetterOutput
+	limit         *adaptiveLimit
+	breaker       *circuitBreaker
 	client        *HTTPClient
 	stopWorker    chan struct{}
+	masterDone    chan struct{} // closed when workerMaster returns
+	workersMu     sync.Mutex    // guards starting workers against Close
+	workers       sync.WaitGroup
 	queue         chan *Message
 	responses     chan *response
-	stop          chan bool // Channel used only to indicate goroutine should shutdown
+	sessionsMu    sync.Mutex
+	sessions      map[string]*webSocketSession // by id of the upgrade request
+	stop          chan bool                    // Channel used only to indicate goroutine should shutdown
 }
 
 // NewHTTPOutput constructor for HTTPOutput
@@ -91,6 +171,14 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 		newConfig.url.Scheme = "http"
 	}
 	newConfig.rawURL = newConfig.url.String()
+	if path, ok := unixSocketPath(address); ok {
+		// requests are sent as to a http:// target, the transport connects to the socket
+		newConfig.socket = path
+		if newConfig.SocketHost == "" {
+			newConfig.SocketHost = "localhost"
+		}
+		newConfig.url = &url.URL{Scheme: "http", Host: newConfig.SocketHost}
+	}
 	if newConfig.Timeout < time.Millisecond*100 {
 		newConfig.Timeout = time.Second
 	}
@@ -118,10 +206,50 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 	if newConfig.WorkerTimeout <= 0 {
 		newConfig.WorkerTimeout = time.Second * 2
 	}
+	switch {
+	case newConfig.Protocol == ProtocolH2 && newConfig.url.Scheme != "https":
+		log.Fatal(fmt.Sprintf("[OUTPUT-HTTP] --output-http-protocol h2 requires https:// target, use h2c for %q", address))
+	case newConfig.Protocol == ProtocolH2C && newConfig.url.Scheme != "http":
+		log.Fatal(fmt.Sprintf("[OUTPUT-HTTP] --output-http-protocol h2c requires http:// target, use h2 for %q", address))
+	}
+	if newConfig.RetryAttempts <= 0 {
+		newConfig.RetryAttempts = 1
+	}
+	if newConfig.RetryBackoff <= 0 {
+		newConfig.RetryBackoff = 100 * time.Millisecond
+	}
+	if newConfig.RetryMaxBackoff <= 0 {
+		newConfig.RetryMaxBackoff = 10 * time.Second
+	}
+	if len(newConfig.RetryOn) == 0 {
+		newConfig.RetryOn = retryConditions
+	}
+	o.retryOn = make(map[string]bool)
+	for _, condition := range newConfig.RetryOn {
+		o.retryOn[condition] = true
+	}
+	if newConfig.DeadLetter != "" {
+		o.deadLetter = openDeadLetter(newConfig.DeadLetter)
+	}
+	if newConfig.BreakerWindow <= 0 {
+		newConfig.BreakerWindow = 10 * time.Second
+	}
+	if newConfig.BreakerCooldown <= 0 {
+		newConfig.BreakerCooldown = 30 * time.Second
+	}
+	o.limit = newAdaptiveLimit(newConfig)
+	o.breaker = newCircuitBreaker(newConfig)
 	o.config = newConfig
 	o.stop = make(chan bool)
+	o.sessions = make(map[string]*webSocketSession)
+	o.stats = expvarMap("output-http-" + o.config.rawURL)
+	for _, key := range []string{"delivered", "failed", "dropped", "retried", "rejected", "dead_letter", "grpc_errors", "websocket_sessions", "websocket_frames"} {
+		o.stats.Add(key, 0)
+	}
+	o.registerMetrics()
 	if o.config.Stats {
-		o.queueStats = NewGorStat("output_http", o.config.StatsMs)
+		o.queueStats = NewGorStat("output_http_queue["+o.config.rawURL+"]", o.config.StatsMs)
+		o.rttStats = NewGorStat("output_http_rtt_ms["+o.config.rawURL+"]", o.config.StatsMs)
 	}
 
 	o.queue = make(chan *Message, o.config.QueueLen)
@@ -130,9 +258,11 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 	}
 	// it should not be buffered to avoid races
 	o.stopWorker = make(chan struct{})
+	o.masterDone = make(chan struct{})
 
 	o.client = NewHTTPClient(o.config)
 	o.activeWorkers += int32(o.config.WorkersMin)
+	o.workers.Add(o.config.WorkersMin)
 	for i := 0; i < o.config.WorkersMin; i++ {
 		go o.startWorker()
 	}
@@ -141,51 +271,99 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 }
 
 func (o *HTTPOutput) workerMaster() {
+	defer close(o.masterDone)
 	var timer = time.NewTimer(o.config.WorkerTimeout)
-	defer func() {
-		// recover from panics caused by trying to send in
-		// a closed chan(o.stopWorker)
-		recover()
-	}()
 	defer timer.Stop()
 	for {
 		select {
 		case <-o.stop:
 			return
-		default:
-			<-timer.C
+		case <-timer.C:
 		}
 		// rollback workers
-	rollback:
-		if atomic.LoadInt32(&o.activeWorkers) > int32(o.config.WorkersMin) && len(o.queue) < 1 {
+		for atomic.LoadInt32(&o.activeWorkers) > int32(o.config.WorkersMin) && len(o.queue) < 1 {
 			// close one worker
-			o.stopWorker <- struct{}{}
-			atomic.AddInt32(&o.activeWorkers, -1)
-			goto rollback
+			select {
+			case o.stopWorker <- struct{}{}:
+				atomic.AddInt32(&o.activeWorkers, -1)
+			case <-o.stop:
+				return
+			}
 		}
 		timer.Reset(o.config.WorkerTimeout)
 	}
 }
 
 func (o *HTTPOutput) startWorker() {
+	defer o.workers.Done()
 	for {
 		select {
 		case <-o.stopWorker:
 			return
 		case msg := <-o.queue:
 			o.sendRequest(o.client, msg)
+			if o.shrinkWorkers() {
+				return
+			}
+		}
+	}
+}
+
+// addWorker starts one more worker unless the output is closed
+func (o *HTTPOutput) addWorker() {
+	o.workersMu.Lock()
+	defer o.workersMu.Unlock()
+	select {
+	case <-o.stop:
+		return
+	default:
+	}
+	o.workers.Add(1)
+	atomic.AddInt32(&o.activeWorkers, 1)
+	go o.startWorker()
+}
+
+// workerLimit returns maximum number of workers, lowered by the adaptive limit when it's enabled
+func (o *HTTPOutput) workerLimit() int32 {
+	if limit := o.limit.Limit(); limit < o.config.WorkersMax {
+		return int32(limit)
+	}
+	return int32(o.config.WorkersMax)
+}
+
+// shrinkWorkers reports whether calling worker should stop because the adaptive limit went down
+func (o *HTTPOutput) shrinkWorkers() bool {
+	if o.limit == nil {
+		return false
+	}
+	for {
+		n := atomic.LoadInt32(&o.activeWorkers)
+		if n <= o.workerLimit() || n <= int32(o.config.WorkersMin) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&o.activeWorkers, n, n-1) {
+			return true
 		}
 	}
 }
 
 // PluginWrite writes message to this plugin
 func (o *HTTPOutput) PluginWrite(msg *Message) (n int, err error) {
+	if IsWebSocketPayload(msg.Meta) {
+		return o.writeWebSocketFrame(msg)
+	}
 	if !IsRequestPayload(msg.Meta) {
 		return len(msg.Data), nil
 	}
+	if isWebSocketRequest(msg.Data) {
+		o.startWebSocketSession(msg)
+		return len(msg.Data) + len(msg.Meta), nil
+	}
 
+	atomic.AddInt64(&o.pending, 1)
 	select {
 	case <-o.stop:
+		atomic.AddInt64(&o.pending, -1)
 		return 0, ErrorStopped
 	case o.queue <- msg:
 	}
@@ -195,9 +373,8 @@ func (o *HTTPOutput) PluginWrite(msg *Message) (n int, err error) {
 	}
 	if len(o.queue) > 0 {
 		// try to start a new worker to serve
-		if atomic.LoadInt32(&o.activeWorkers) < int32(o.config.WorkersMax) {
-			go o.startWorker()
-			atomic.AddInt32(&o.activeWorkers, 1)
+		if atomic.LoadInt32(&o.activeWorkers) < o.workerLimit() {
+			o.addWorker()
 		}
 	}
 	return len(msg.Data) + len(msg.Meta), nil
@@ -212,12 +389,20 @@ func (o *HTTPOutput) PluginRead() (*Message, error) {
 	var msg Message
 	select {
 	case <-o.stop:
-		return nil, ErrorStopped
+		// responses received before Close are still delivered
+		select {
+		case resp = <-o.responses:
+		default:
+			return nil, ErrorStopped
+		}
 	case resp = <-o.responses:
-		msg.Data = resp.payload
 	}
+	msg.Data = resp.payload
 
 	msg.Meta = PayloadHeader(ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+	if resp.truncated {
+		msg.Meta = PayloadMetaAppend(msg.Meta, MetaField("truncated", "1"))
+	}
 
 	return &msg, nil
 }
@@ -227,47 +412,184 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 		return
 	}
 
+	defer atomic.AddInt64(&o.pending, -1)
+
 	uuid := PayloadID(msg.Meta)
-	start := time.Now()
-	resp, err := client.Send(msg.Data)
-	stop := time.Now()
+	var payload []byte
+	var truncated bool
+	var resp *http.Response
+	var err error
+	var start, stop time.Time
+	var reason string
+	attempt := 1
+	for ; ; attempt++ {
+		if !o.breaker.Allow() {
+			o.stats.Add("rejected", 1)
+			o.writeDeadLetter(msg, attempt-1, "circuit-open")
+			return
+		}
+		start = time.Now()
+		payload, truncated, resp, err = client.Send(msg.Data)
+		stop = time.Now()
+
+		reason = failureReason(resp, err)
+		// requests which could not be sent say nothing about the target
+		if reason != "invalid" {
+			o.breaker.Record(reason != "")
+			o.limit.Record(stop.Sub(start), reason != "")
+		} else {
+			o.breaker.Cancel()
+		}
+		if !o.retryOn[reason] || attempt >= o.config.RetryAttempts {
+			break
+		}
+		o.stats.Add("retried", 1)
+		metrics.Counter("httpcopy_http_output_retries_total", "Retried attempts of replayed requests by condition.",
+			"target", o.config.rawURL, "condition", reason).Add(1)
+		Debug(2, fmt.Sprintf("[HTTP-OUTPUT] retrying %s after attempt %d: %s", uuid, attempt, reason))
+		if !o.sleep(o.retryDelay(attempt, resp)) {
+			break
+		}
+	}
 
+	// responses are retryable failures only if retries are enabled, otherwise they are delivered as they are
+	exhausted := err != nil || (o.retryOn[reason] && o.config.RetryAttempts > 1)
+	if exhausted {
+		o.writeDeadLetter(msg, attempt, reason)
+	}
 	if err != nil {
+		o.stats.Add("failed", 1)
 		fmt.Println(1, fmt.Sprintf("[HTTP-OUTPUT] error when sending: %q", err))
 		return
 	}
+	if exhausted {
+		o.stats.Add("failed", 1)
+	} else {
+		o.stats.Add("delivered", 1)
+	}
 	if resp == nil {
 		return
 	}
+	o.latency.Observe(stop.Sub(start).Seconds())
+	if o.config.Stats {
+		o.rttStats.Write(int(stop.Sub(start) / time.Millisecond))
+	}
+	metrics.Counter("httpcopy_http_output_responses_total", "Responses of replayed requests by status code.",
+		"target", o.config.rawURL, "code", strconv.Itoa(resp.StatusCode)).Add(1)
+	if status := grpcStatus(resp); status != "" {
+		if status != "0" {
+			o.stats.Add("grpc_errors", 1)
+		}
+		metrics.Counter("httpcopy_http_output_grpc_responses_total", "Responses of replayed gRPC calls by grpc-status.",
+			"target", o.config.rawURL, "status", status).Add(1)
+	}
+	if payload == nil {
+		return
+	}
 
 	if o.config.TrackResponses {
-		o.responses <- &response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+		select {
+		case o.responses <- &response{payload, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano(), truncated}:
+		case <-o.stop:
+		}
 	}
 
 }
 
+func (o *HTTPOutput) registerMetrics() {
+	target := o.config.rawURL
+	plugin := o.String()
+	metrics.CounterFunc("httpcopy_plugin_dropped_total", "Messages dropped by the plugin.", func() float64 {
+		return float64(expvarInt(o.stats, "dropped"))
+	}, "plugin", plugin)
+	metrics.GaugeFunc("httpcopy_plugin_queue_depth", "Messages waiting in the plugin queue.", func() float64 {
+		return float64(len(o.queue))
+	}, "plugin", plugin)
+	metrics.CounterFunc("httpcopy_http_output_errors_total", "Replayed requests which failed without response.", func() float64 {
+		return float64(expvarInt(o.stats, "failed"))
+	}, "target", target)
+	metrics.GaugeFunc("httpcopy_http_output_workers", "Active workers of HTTP output.", func() float64 {
+		return float64(atomic.LoadInt32(&o.activeWorkers))
+	}, "target", target)
+	metrics.GaugeFunc("httpcopy_http_output_concurrency_limit", "Maximum number of workers allowed by --output-http-adaptive.", func() float64 {
+		return float64(o.workerLimit())
+	}, "target", target)
+	metrics.GaugeFunc("httpcopy_http_output_breaker_state", "Circuit breaker state: 0 closed, 1 open, 2 half-open.", func() float64 {
+		return float64(o.breaker.State())
+	}, "target", target)
+	metrics.CounterFunc("httpcopy_http_output_rejected_total", "Requests not sent because circuit breaker was open.", func() float64 {
+		return float64(expvarInt(o.stats, "rejected"))
+	}, "target", target)
+	o.latency = metrics.Histogram("httpcopy_http_output_latency_seconds", "Time to get response of replayed request.", "target", target)
+}
+
+// Drain waits until queued requests are sent or deadline passes, and returns number of requests still pending
+func (o *HTTPOutput) Drain(deadline time.Time) int {
+	for {
+		pending := atomic.LoadInt64(&o.pending)
+		if pending == 0 || !time.Now().Before(deadline) {
+			return int(pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Summary returns counters of delivered, failed and dropped requests, and number of requests still pending
+func (o *HTTPOutput) Summary() map[string]int64 {
+	summary := expvarSummary(o.stats)
+	summary["pending"] = atomic.LoadInt64(&o.pending)
+	return summary
+}
+
+func (o *HTTPOutput) returnsResponses() bool {
+	return o.config.TrackResponses
+}
+
 func (o *HTTPOutput) String() string {
 	return "HTTP output: " + o.config.rawURL
 }
 
-// Close closes the data channel so that data
+// Close stops workers, requests left in the queue are dropped. See Drain to wait for them first.
 func (o *HTTPOutput) Close() error {
+	o.workersMu.Lock()
 	close(o.stop)
+	o.workersMu.Unlock()
+	// workerMaster may be stopping a worker, stopWorker is closed once it can't send anymore
+	<-o.masterDone
 	close(o.stopWorker)
-	return nil
+	// requests being sent may still be dead-lettered
+	o.workers.Wait()
+	if o.config.Stats {
+		o.queueStats.Close()
+		o.rttStats.Close()
+	}
+	if o.deadLetter != nil {
+		defer o.deadLetter.Close()
+	}
+	for {
+		select {
+		case <-o.queue:
+			atomic.AddInt64(&o.pending, -1)
+			o.stats.Add("dropped", 1)
+		default:
+			return nil
+		}
+	}
 }
 
 // HTTPClient holds configurations for a single HTTP client
 type HTTPClient struct {
 	config *HTTPOutputConfig
 	Client *http.Client
+	grpc   *http.Client // HTTP/2 client for gRPC calls
+	// webSocket is HTTP/1.1 transport for upgrade requests, which have no overall timeout
+	webSocket *http.Transport
 }
 
 // NewHTTPClient returns new http client with check redirects policy
 func NewHTTPClient(config *HTTPOutputConfig) *HTTPClient {
 	client := new(HTTPClient)
 	client.config = config
-	var transport *http.Transport
 	client.Client = &http.Client{
 		Timeout: client.config.Timeout,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -281,30 +603,107 @@ func NewHTTPClient(config *HTTPOutputConfig) *HTTPClient {
 			return nil
 		},
 	}
-	if config.SkipVerify {
-		// clone to avoid modying global default RoundTripper
-		transport = http.DefaultTransport.(*http.Transport).Clone()
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		client.Client.Transport = transport
-	}
+	transport := newHTTPTransport(config)
+	client.Client.Transport = transport
+	client.grpc = &http.Client{Timeout: config.Timeout, Transport: newGRPCTransport(transport, config.url)}
+	client.webSocket = newWebSocketTransport(transport, config)
 
 	return client
 }
 
-// Send sends an http request using client create by NewHTTPClient
-func (c *HTTPClient) Send(data []byte) ([]byte, error) {
-	var req *http.Request
-	var resp *http.Response
-	var err error
+// Protocols of --output-http-protocol, by default HTTP/2 is used only if an https:// target offers it
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"  // HTTP/2 over TLS
+	ProtocolH2C   = "h2c" // cleartext HTTP/2 with prior knowledge
+)
+
+// newHTTPTransport returns transport with TLS, proxy and connection pool settings of the output
+func newHTTPTransport(config *HTTPOutputConfig) *http.Transport {
+	// clone to avoid modying global default RoundTripper
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SkipVerify, ServerName: config.TLSServerName}
+	if config.TLSCA != "" {
+		pool, err := loadCertPool(config.TLSCA)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("[HTTPCLIENT] CA bundle error[%q]", err))
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.TLSCert != "" || config.TLSKey != "" {
+		reloader, err := newTLSReloader(config.TLSCert, config.TLSKey, "")
+		if err != nil {
+			log.Fatal(fmt.Sprintf("[HTTPCLIENT] client certificate error[%q]", err))
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &reloader.current().Certificates[0], nil
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if config.socket != "" {
+		var dialer net.Dialer
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", config.socket)
+		}
+		// HTTP_PROXY can't be used with a socket
+		transport.Proxy = nil
+	}
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("[HTTPCLIENT] parse proxy URL error[%q]", err))
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < config.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = config.MaxIdleConnsPerHost
+		}
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	transport.DisableKeepAlives = config.DisableKeepAlives
+	transport.DisableCompression = config.DisableCompression
+
+	if config.Protocol != "" {
+		protocols := new(http.Protocols)
+		switch config.Protocol {
+		case ProtocolHTTP1:
+			protocols.SetHTTP1(true)
+		case ProtocolH2:
+			protocols.SetHTTP2(true)
+		case ProtocolH2C:
+			protocols.SetUnencryptedHTTP2(true)
+		}
+		transport.Protocols = protocols
+	}
+
+	return transport
+}
 
-	req, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+// removeConnectionHeaders drops HTTP/1.1 connection-specific headers, which are invalid in HTTP/2
+func removeConnectionHeaders(header http.Header) {
+	for _, name := range strings.Split(header.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			header.Del(name)
+		}
+	}
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Upgrade"} {
+		header.Del(name)
+	}
+}
+
+// newRequest parses recorded request and points it to the target
+func (c *HTTPClient) newRequest(data []byte) (*http.Request, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
 		return nil, err
 	}
-	// we don't send CONNECT or OPTIONS request
-	if req.Method == http.MethodConnect {
-		return nil, nil
-	}
 
 	if !c.config.OriginalHost {
 		req.Host = c.config.url.Host
@@ -318,18 +717,73 @@ func (c *HTTPClient) Send(data []byte) ([]byte, error) {
 		req.URL = c.config.url
 	}
 
-	// force connection to not be closed, which can affect the global client
-	req.Close = false
 	// it's an error if this is not equal to empty string
 	req.RequestURI = ""
+	return req, nil
+}
 
-	resp, err = c.Client.Do(req)
+// Send sends an http request using client create by NewHTTPClient, and returns response dump if responses are tracked.
+// Response is nil if the request was not sent, its body is already read and closed.
+func (c *HTTPClient) Send(data []byte) (payload []byte, truncated bool, resp *http.Response, err error) {
+	var req *http.Request
+
+	req, err = c.newRequest(data)
 	if err != nil {
-		return nil, err
+		return nil, false, nil, err
 	}
-	if c.config.TrackResponses {
-		return httputil.DumpResponse(resp, true)
+	// we don't send CONNECT or OPTIONS request
+	if req.Method == http.MethodConnect {
+		return nil, false, nil, nil
+	}
+
+	client := c.Client
+	if isGRPC(req.Header) {
+		client = c.grpc
+		prepareGRPCRequest(req)
+	} else if c.config.Protocol == ProtocolH2 || c.config.Protocol == ProtocolH2C {
+		removeConnectionHeaders(req.Header)
 	}
+
+	// force connection to not be closed, which can affect the global client
+	req.Close = false
+
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if !c.config.TrackResponses {
+		if isGRPC(resp.Header) {
+			discardBody(resp)
+		} else {
+			_ = resp.Body.Close()
+		}
+		return nil, false, resp, nil
+	}
+	limit := int(c.config.BufferSize)
+	if isGRPC(resp.Header) {
+		// grpc-status comes in trailers, so the whole body is read before it's capped
+		payload, err = dumpGRPCResponse(resp)
+	} else {
+		payload, err = dumpResponse(resp, limit)
+	}
+	if err == nil && len(payload) > limit {
+		payload, truncated = truncatePayload(payload, limit), true
+	}
+	return payload, truncated, resp, err
+}
+
+// dumpResponse returns the response in wire format with at most limit bytes of the body, the rest is not read.
+// resp.Body is replaced with the read part of the body.
+func dumpResponse(resp *http.Response, limit int) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
 	_ = resp.Body.Close()
-	return nil, nil
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		// the dump is cut to limit by the caller, its Content-Length must match the body it has
+		resp.TransferEncoding, resp.ContentLength = nil, int64(len(body))
+	}
+	return httputil.DumpResponse(resp, true)
 }
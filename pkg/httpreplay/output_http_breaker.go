@@ -0,0 +1,188 @@
+package httpreplay
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// States of the circuit breaker, as reported by httpcopy_http_output_breaker_state
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops sending requests to a target once the error rate within the window
+// reaches the threshold. After cooldown a single trial request is let through:
+// the breaker closes if it succeeds and opens again if it fails.
+// Methods of nil breaker let every request through.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	errorRate   float64
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	trial       bool // trial request of half-open state is in flight
+}
+
+func newCircuitBreaker(config *HTTPOutputConfig) *circuitBreaker {
+	if config.BreakerErrorRate <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		errorRate:   config.BreakerErrorRate,
+		minRequests: config.BreakerMinRequests,
+		window:      config.BreakerWindow,
+		cooldown:    config.BreakerCooldown,
+		windowStart: time.Now(),
+	}
+}
+
+// Allow reports whether request may be sent now
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// Record counts result of a request let through by Allow
+func (b *circuitBreaker) Record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		// request was sent before the breaker opened
+		return
+	case breakerHalfOpen:
+		b.trial = false
+		if failed {
+			b.state, b.openedAt = breakerOpen, now
+		} else {
+			b.state = breakerClosed
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		return
+	}
+
+	if now.Sub(b.windowStart) > b.window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.errorRate {
+		b.state, b.openedAt = breakerOpen, now
+		Debug(1, "[HTTP-OUTPUT] circuit breaker opened, error rate", float64(b.failures)/float64(b.requests))
+	}
+}
+
+// Cancel releases the trial slot of a request let through by Allow whose result says nothing
+// about the target, e.g. because it could not be sent, so the next request becomes the trial
+func (b *circuitBreaker) Cancel() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.trial = false
+	}
+}
+
+// State returns breakerClosed, breakerOpen or breakerHalfOpen
+func (b *circuitBreaker) State() int {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// adaptiveLimit limits number of concurrent requests using AIMD: the limit grows by one
+// per limit successful requests, and is cut by decreaseRatio on errors or when latency exceeds the target.
+// Methods of nil limit return the configured maximum.
+type adaptiveLimit struct {
+	mu           sync.Mutex
+	limit        float64
+	min, max     float64
+	latency      time.Duration
+	lastDecrease time.Time
+}
+
+// decreaseRatio is applied to the limit on every congestion signal, at most once per round trip
+const decreaseRatio = 0.9
+
+func newAdaptiveLimit(config *HTTPOutputConfig) *adaptiveLimit {
+	if !config.Adaptive {
+		return nil
+	}
+	return &adaptiveLimit{
+		limit:   float64(config.WorkersMin),
+		min:     float64(config.WorkersMin),
+		max:     float64(config.WorkersMax),
+		latency: config.AdaptiveLatency,
+	}
+}
+
+// Record adjusts the limit by result of a request
+func (l *adaptiveLimit) Record(rtt time.Duration, failed bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if failed || (l.latency > 0 && rtt > l.latency) {
+		// requests sent before the previous decrease don't reflect it yet
+		if time.Since(l.lastDecrease) < rtt {
+			return
+		}
+		l.lastDecrease = time.Now()
+		l.limit = math.Max(l.min, l.limit*decreaseRatio)
+		return
+	}
+	l.limit = math.Min(l.max, l.limit+1/l.limit)
+}
+
+// Limit returns current number of allowed concurrent requests
+func (l *adaptiveLimit) Limit() int {
+	if l == nil {
+		return math.MaxInt32
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
@@ -0,0 +1,150 @@
+package httpreplay
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Conditions of --output-http-retry-on
+const (
+	RetryOnError   = "error"   // connection errors
+	RetryOnTimeout = "timeout" // --output-http-timeout exceeded
+	RetryOn5xx     = "5xx"
+	RetryOn429     = "429" // waits for Retry-After if the response has it
+)
+
+// retryConditions are used when --output-http-retry-on is not set
+var retryConditions = []string{RetryOnError, RetryOnTimeout, RetryOn5xx, RetryOn429}
+
+// failureReason returns condition matched by result of the attempt, "invalid" for requests
+// which could not be sent at all, or "" if the attempt succeeded
+func failureReason(resp *http.Response, err error) string {
+	var urlErr *url.Error
+	switch {
+	case err != nil && errors.As(err, &urlErr) && urlErr.Timeout():
+		return RetryOnTimeout
+	case err != nil && errors.As(err, &urlErr):
+		return RetryOnError
+	case err != nil:
+		return "invalid"
+	case resp == nil:
+		return ""
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return RetryOn429
+	case resp.StatusCode >= 500:
+		return RetryOn5xx
+	}
+	return ""
+}
+
+// retryDelay returns how long to wait after the attempt: Retry-After of 429 responses, otherwise
+// exponential backoff with jitter, between half and full of backoff*2^(attempt-1). Both are capped by max backoff.
+func (o *HTTPOutput) retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if delay, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			if delay > o.config.RetryMaxBackoff {
+				delay = o.config.RetryMaxBackoff
+			}
+			return delay
+		}
+	}
+
+	delay := o.config.RetryBackoff
+	for i := 1; i < attempt && delay < o.config.RetryMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.config.RetryMaxBackoff {
+		delay = o.config.RetryMaxBackoff
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// retryAfter parses Retry-After header, given either in seconds or as HTTP date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sleep waits before the next attempt, returns false if the output was closed meanwhile
+func (o *HTTPOutput) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-o.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// writeDeadLetter saves request which ultimately failed, so it can be replayed later with --input-file.
+// Number of attempts and the reason of the last failure are added to the meta.
+func (o *HTTPOutput) writeDeadLetter(msg *Message, attempts int, reason string) {
+	if o.deadLetter == nil {
+		return
+	}
+	o.stats.Add("dead_letter", 1)
+	letter := &Message{
+		Meta: PayloadMetaAppend(msg.Meta, MetaField("attempts", strconv.Itoa(attempts)), MetaField("failure", reason)),
+		Data: msg.Data,
+	}
+	if _, err := o.deadLetter.PluginWrite(letter); err != nil {
+		Debug(1, fmt.Sprintf("[HTTP-OUTPUT] dead letter write error: %q", err))
+	}
+}
+
+// deadLetters are file outputs shared by HTTP outputs with the same --output-http-dead-letter path
+var deadLetters = struct {
+	sync.Mutex
+	outputs map[string]*deadLetterOutput
+}{outputs: make(map[string]*deadLetterOutput)}
+
+type deadLetterOutput struct {
+	*FileOutput
+	path string
+	refs int
+}
+
+// openDeadLetter returns dead letter output for path, which must be closed by every user
+func openDeadLetter(path string) *deadLetterOutput {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	d := deadLetters.outputs[path]
+	if d == nil {
+		d = &deadLetterOutput{FileOutput: NewFileOutput(path, &FileOutputConfig{Append: true}), path: path}
+		deadLetters.outputs[path] = d
+	}
+	d.refs++
+	return d
+}
+
+// Close closes the file once the last HTTP output using it is closed
+func (d *deadLetterOutput) Close() error {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	if d.refs--; d.refs > 0 {
+		return nil
+	}
+	delete(deadLetters.outputs, d.path)
+	return d.FileOutput.Close()
+}
@@ -1 +1,425 @@
 package httpreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"httpcopy/pkg/proto"
+)
+
+func TestHTTPOutputRetry(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{RetryAttempts: 3, RetryBackoff: time.Millisecond}).(*HTTPOutput)
+	before := output.Summary()
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+	output.Drain(time.Now().Add(5 * time.Second))
+	output.Close()
+
+	summary := output.Summary()
+	if atomic.LoadInt64(&requests) != 3 || summary["retried"]-before["retried"] != 2 || summary["delivered"]-before["delivered"] != 1 {
+		t.Errorf("Expected request to succeed on the third attempt, got %d requests: %v", requests, summary)
+	}
+}
+
+func TestHTTPOutputDeadLetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "dead.gor")
+	config := &HTTPOutputConfig{RetryAttempts: 2, RetryBackoff: time.Millisecond, RetryOn: []string{RetryOn5xx}, DeadLetter: path}
+	output := NewHTTPOutput(server.URL, config).(*HTTPOutput)
+	before := output.Summary()
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET /failed HTTP/1.1\r\n\r\n")})
+	output.Drain(time.Now().Add(5 * time.Second))
+	output.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "attempts=2 failure=5xx\n") || !strings.Contains(string(data), "GET /failed HTTP/1.1") {
+		t.Errorf("Expected failed request with attempts and failure reason, got %q", data)
+	}
+	if summary := output.Summary(); summary["failed"]-before["failed"] != 1 || summary["delivered"]-before["delivered"] != 0 {
+		t.Errorf("Dead-lettered response should be counted as failed only: %v", summary)
+	}
+
+	// without retries the response is delivered as it is
+	path = filepath.Join(t.TempDir(), "dead.gor")
+	output = NewHTTPOutput(server.URL, &HTTPOutputConfig{DeadLetter: path}).(*HTTPOutput)
+	before = output.Summary()
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET /failed HTTP/1.1\r\n\r\n")})
+	output.Drain(time.Now().Add(5 * time.Second))
+	output.Close()
+
+	if data, _ := os.ReadFile(path); len(data) > 0 {
+		t.Errorf("Response should not be dead-lettered without retries, got %q", data)
+	}
+	if summary := output.Summary(); summary["failed"]-before["failed"] != 0 || summary["delivered"]-before["delivered"] != 1 {
+		t.Errorf("Expected response to be counted as delivered: %v", summary)
+	}
+}
+
+func TestHTTPOutputDeadLetterOnClose(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "dead.gor")
+	config := &HTTPOutputConfig{RetryAttempts: 2, RetryBackoff: time.Second, RetryOn: []string{RetryOn5xx}, DeadLetter: path}
+	output := NewHTTPOutput(server.URL, config).(*HTTPOutput)
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET /closing HTTP/1.1\r\n\r\n")})
+	<-received
+	// the request is still being sent
+	output.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "GET /closing HTTP/1.1") {
+		t.Errorf("Request being sent on close should be dead-lettered, got %q", data)
+	}
+	if _, err := output.deadLetter.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1)}); err != ErrorStopped {
+		t.Errorf("Closed dead letter should not be reopened, got %v", err)
+	}
+}
+
+func TestHTTPOutputResponseBuffer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 1000)))
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{TrackResponses: true, BufferSize: 200}).(*HTTPOutput)
+	defer output.Close()
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+	msg, err := output.PluginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, truncated := PayloadMetaField(msg.Meta, "truncated"); len(msg.Data) > 200 || !truncated {
+		t.Errorf("Expected response capped at buffer size and marked truncated, got %d bytes: %q", len(msg.Data), msg.Meta)
+	}
+	if resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msg.Data)), nil); err != nil || resp.ContentLength != int64(len(msg.Data)-proto.MIMEHeadersEndPos(msg.Data)) {
+		t.Errorf("Capped response should stay parseable, got %v: %q", err, msg.Data)
+	}
+}
+
+func TestHTTPOutputRetryDelay(t *testing.T) {
+	o := &HTTPOutput{config: &HTTPOutputConfig{RetryBackoff: 100 * time.Millisecond, RetryMaxBackoff: time.Second}}
+	for _, tt := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+	} {
+		if delay := o.retryDelay(tt.attempt, nil); delay < tt.min || delay > tt.max {
+			t.Errorf("Attempt %d: expected delay between %s and %s, got %s", tt.attempt, tt.min, tt.max, delay)
+		}
+	}
+
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"120"}}}
+	if delay := o.retryDelay(1, resp); delay != time.Second {
+		t.Errorf("Retry-After should be capped by max backoff, got %s", delay)
+	}
+	resp.Header.Set("Retry-After", "0")
+	if delay := o.retryDelay(1, resp); delay != 0 {
+		t.Errorf("Expected Retry-After delay, got %s", delay)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(&HTTPOutputConfig{BreakerErrorRate: 0.5, BreakerMinRequests: 4, BreakerWindow: time.Minute, BreakerCooldown: 20 * time.Millisecond})
+	for _, failed := range []bool{false, true, false} {
+		b.Allow()
+		b.Record(failed)
+	}
+	if b.State() != breakerClosed {
+		t.Error("Breaker should wait for minimum number of requests")
+	}
+	b.Record(true)
+	if b.State() != breakerOpen || b.Allow() {
+		t.Error("Breaker should open at error rate 0.5")
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if !b.Allow() || b.State() != breakerHalfOpen {
+		t.Error("Breaker should let a trial request through after cooldown")
+	}
+	if b.Allow() {
+		t.Error("Only one trial request should be let through")
+	}
+	b.Cancel()
+	if b.State() != breakerHalfOpen || !b.Allow() {
+		t.Error("Cancelled trial should let the next request through")
+	}
+	b.Record(false)
+	if b.State() != breakerClosed || !b.Allow() {
+		t.Error("Breaker should close after successful trial")
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	l := newAdaptiveLimit(&HTTPOutputConfig{Adaptive: true, WorkersMin: 1, WorkersMax: 10, AdaptiveLatency: 100 * time.Millisecond})
+	for i := 0; i < 20; i++ {
+		l.Record(time.Millisecond, false)
+	}
+	if limit := l.Limit(); limit < 5 || limit > 6 {
+		t.Errorf("Limit should grow by one per round of successful requests, got %d", limit)
+	}
+	for i := 0; i < 100; i++ {
+		l.Record(time.Millisecond, false)
+	}
+	if l.Limit() != 10 {
+		t.Errorf("Limit should be capped by --output-http-workers, got %d", l.Limit())
+	}
+
+	l.Record(200*time.Millisecond, false)
+	if l.Limit() != 9 {
+		t.Errorf("Slow response should cut the limit, got %d", l.Limit())
+	}
+	l.Record(200*time.Millisecond, true)
+	if l.Limit() != 9 {
+		t.Errorf("Limit should be cut at most once per round trip, got %d", l.Limit())
+	}
+
+	var disabled *adaptiveLimit
+	disabled.Record(0, true)
+	if disabled.Limit() <= 10 {
+		t.Error("Disabled limit should not restrict workers")
+	}
+}
+
+func TestHTTPOutputCircuitBreaker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "rejected.gor")
+	config := &HTTPOutputConfig{WorkersMax: 1, BreakerErrorRate: 0.5, BreakerMinRequests: 2, DeadLetter: path, RetryOn: []string{RetryOnTimeout}}
+	output := NewHTTPOutput(server.URL, config).(*HTTPOutput)
+	before := output.Summary()
+	for i := 0; i < 5; i++ {
+		output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+	}
+	output.Drain(time.Now().Add(5 * time.Second))
+	output.Close()
+
+	summary := output.Summary()
+	if summary["delivered"]-before["delivered"] != 2 || summary["rejected"]-before["rejected"] != 3 {
+		t.Errorf("Expected breaker to open after 2 failed requests: %v", summary)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Count(string(data), "failure=circuit-open") != 3 {
+		t.Errorf("Rejected requests should be written to dead letter file, got %q", data)
+	}
+}
+
+func TestHTTPOutputCircuitBreakerInvalidTrial(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	config := &HTTPOutputConfig{WorkersMax: 1, BreakerErrorRate: 0.5, BreakerMinRequests: 2, BreakerCooldown: 10 * time.Millisecond, RetryOn: []string{RetryOnTimeout}}
+	output := NewHTTPOutput(server.URL, config).(*HTTPOutput)
+	defer output.Close()
+	write := func(data string) {
+		output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte(data)})
+		output.Drain(time.Now().Add(5 * time.Second))
+	}
+	write("GET / HTTP/1.1\r\n\r\n")
+	write("GET / HTTP/1.1\r\n\r\n")
+	if output.breaker.State() != breakerOpen {
+		t.Fatal("Expected breaker to open after 2 failed requests")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	before := output.Summary()
+	write("not a request")
+	write("GET / HTTP/1.1\r\n\r\n")
+	summary := output.Summary()
+	if summary["rejected"]-before["rejected"] != 0 || output.breaker.State() != breakerClosed {
+		t.Errorf("Unparseable trial request should not keep the breaker half-open: %v", summary)
+	}
+}
+
+func TestHTTPOutputCloseStopsWorkers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	for i := 0; i < 10; i++ {
+		output := NewHTTPOutput(server.URL, &HTTPOutputConfig{WorkersMax: 10, WorkerTimeout: time.Millisecond}).(*HTTPOutput)
+		for n := 0; n < 10; n++ {
+			output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+		}
+		output.Drain(time.Now().Add(5 * time.Second))
+		// workerMaster is stopping idle workers meanwhile
+		time.Sleep(time.Duration(i) * time.Millisecond)
+		output.Close()
+
+		select {
+		case <-output.masterDone:
+		default:
+			t.Fatal("Close should wait for workerMaster to stop")
+		}
+	}
+}
+
+func TestHTTPOutputTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeTestCert(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeTestCert(t, dir, "staging.internal", ca, caKey)
+	_, _, clientCert, clientKey := writeTestCert(t, dir, "client", ca, caKey)
+
+	received := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.TLS.ServerName + " " + r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	keyPair, _ := tls.LoadX509KeyPair(serverCert, serverKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{keyPair}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	config := &HTTPOutputConfig{TLSCert: clientCert, TLSKey: clientKey, TLSCA: caFile, TLSServerName: "staging.internal"}
+	output := NewHTTPOutput(server.URL, config).(*HTTPOutput)
+	defer output.Close()
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+
+	select {
+	case r := <-received:
+		if r != "staging.internal client" {
+			t.Errorf("Expected SNI and client certificate, got %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request was not received:", output.Summary())
+	}
+}
+
+func TestHTTPOutputProxy(t *testing.T) {
+	received := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.String()
+	}))
+	defer proxy.Close()
+
+	output := NewHTTPOutput("http://staging.invalid", &HTTPOutputConfig{Proxy: proxy.URL, MaxIdleConnsPerHost: 10}).(*HTTPOutput)
+	defer output.Close()
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET /path HTTP/1.1\r\n\r\n")})
+
+	select {
+	case r := <-received:
+		if r != "http://staging.invalid/path" {
+			t.Errorf("Expected request to the target through proxy, got %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request was not received by proxy")
+	}
+}
+
+func TestHTTPOutputProtocol(t *testing.T) {
+	received := make(chan string, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Proto + " " + r.Header.Get("Upgrade")
+	})
+
+	cleartext := httptest.NewUnstartedServer(handler)
+	cleartext.Config.Protocols = new(http.Protocols)
+	cleartext.Config.Protocols.SetHTTP1(true)
+	cleartext.Config.Protocols.SetUnencryptedHTTP2(true)
+	cleartext.Start()
+	defer cleartext.Close()
+
+	encrypted := httptest.NewUnstartedServer(handler)
+	encrypted.EnableHTTP2 = true
+	encrypted.StartTLS()
+	defer encrypted.Close()
+
+	for _, tt := range []struct {
+		url, protocol string
+	}{
+		{cleartext.URL, ProtocolH2C},
+		{encrypted.URL, ProtocolH2},
+	} {
+		output := NewHTTPOutput(tt.url, &HTTPOutputConfig{Protocol: tt.protocol, SkipVerify: true}).(*HTTPOutput)
+		output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET / HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")})
+
+		select {
+		case r := <-received:
+			if r != "HTTP/2.0 " {
+				t.Errorf("Expected %s request without connection headers, got %q", tt.protocol, r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Request was not received:", output.Summary())
+		}
+		output.Close()
+	}
+}
+
+func TestHTTPOutputUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Host + r.URL.String()
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	output := NewHTTPOutput("unix://"+path, &HTTPOutputConfig{SocketHost: "app.internal"}).(*HTTPOutput)
+	defer output.Close()
+	if output.String() != "HTTP output: unix://"+path {
+		t.Errorf("Unexpected name %q", output.String())
+	}
+	output.PluginWrite(&Message{Meta: PayloadHeader(RequestPayload, Uuid(), 1, -1), Data: []byte("GET /path HTTP/1.1\r\nHost: www.example.com\r\n\r\n")})
+
+	select {
+	case r := <-received:
+		if r != "app.internal/path" {
+			t.Errorf("Expected request with configured Host, got %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request was not received:", output.Summary())
+	}
+}
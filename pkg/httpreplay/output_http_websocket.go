@@ -0,0 +1,182 @@
+package httpreplay
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+)
+
+// webSocketIdleTimeout closes replayed sessions which got no frames for this long,
+// e.g. when the recording ended before the session was closed
+var webSocketIdleTimeout = time.Minute
+
+// webSocketSession replays client frames of a recorded session over its own connection,
+// each frame is sent at the same offset from the upgrade as it was recorded
+type webSocketSession struct {
+	id        string
+	startedAt int64 // recorded time of the upgrade request
+	frames    chan *Message
+	done      chan struct{}
+}
+
+// newWebSocketTransport returns copy of the output transport which always uses HTTP/1.1, as WebSocket upgrade requires
+func newWebSocketTransport(transport *http.Transport, config *HTTPOutputConfig) *http.Transport {
+	ws := transport.Clone()
+	ws.Protocols = new(http.Protocols)
+	ws.Protocols.SetHTTP1(true)
+	ws.ResponseHeaderTimeout = config.Timeout
+	return ws
+}
+
+// dialWebSocket sends recorded upgrade request and returns connection of the new session
+func (c *HTTPClient) dialWebSocket(data []byte) (io.ReadWriteCloser, *http.Response, error) {
+	req, err := c.newRequest(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := c.webSocket.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		resp.Body.Close()
+		return nil, resp, fmt.Errorf("WebSocket upgrade failed: %s", resp.Status)
+	}
+	return conn, resp, nil
+}
+
+// startWebSocketSession opens the session of the upgrade request, frames written meanwhile wait in its queue
+func (o *HTTPOutput) startWebSocketSession(msg *Message) {
+	s := &webSocketSession{
+		id:        string(PayloadID(msg.Meta)),
+		startedAt: payloadTimestamp(msg.Meta),
+		frames:    make(chan *Message, o.config.QueueLen),
+		done:      make(chan struct{}),
+	}
+
+	o.sessionsMu.Lock()
+	o.sessions[s.id] = s
+	o.sessionsMu.Unlock()
+	o.stats.Add("websocket_sessions", 1)
+
+	go o.replayWebSocket(s, msg)
+}
+
+// writeWebSocketFrame passes client frame to its session, frames of the target are not sent
+func (o *HTTPOutput) writeWebSocketFrame(msg *Message) (int, error) {
+	if dir, _ := PayloadMetaField(msg.Meta, "dir"); dir != "client" {
+		return len(msg.Data), nil
+	}
+	o.sessionsMu.Lock()
+	s := o.sessions[string(PayloadID(msg.Meta))]
+	o.sessionsMu.Unlock()
+	if s == nil {
+		Debug(2, fmt.Sprintf("[HTTP-OUTPUT] WebSocket frame of unknown session %s", PayloadID(msg.Meta)))
+		return len(msg.Data), nil
+	}
+
+	// a slow session must not hold up traffic of other sessions and outputs
+	select {
+	case s.frames <- msg:
+	case <-s.done:
+		o.stats.Add("dropped", 1)
+	case <-o.stop:
+		return 0, ErrorStopped
+	default:
+		Debug(2, fmt.Sprintf("[HTTP-OUTPUT] WebSocket session %s can't keep up, frame dropped", s.id))
+		o.stats.Add("dropped", 1)
+	}
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+func (o *HTTPOutput) replayWebSocket(s *webSocketSession, msg *Message) {
+	defer func() {
+		o.sessionsMu.Lock()
+		delete(o.sessions, s.id)
+		o.sessionsMu.Unlock()
+		close(s.done)
+	}()
+
+	start := time.Now()
+	conn, resp, err := o.client.dialWebSocket(msg.Data)
+	if err != nil {
+		o.stats.Add("failed", 1)
+		Debug(1, fmt.Sprintf("[HTTP-OUTPUT] WebSocket session %s: %q", s.id, err))
+		return
+	}
+	defer conn.Close()
+	o.stats.Add("delivered", 1)
+	if o.config.TrackResponses {
+		if payload, err := httputil.DumpResponse(resp, false); err == nil {
+			select {
+			case o.responses <- &response{payload, []byte(s.id), start.UnixNano(), time.Since(start).Nanoseconds(), false}:
+			case <-o.stop:
+			}
+		}
+	}
+
+	// frames of the target are read only to detect the end of the session
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	idle := time.NewTimer(webSocketIdleTimeout)
+	defer idle.Stop()
+	for {
+		var frame *Message
+		select {
+		case frame = <-s.frames:
+		case <-closed:
+			return
+		case <-idle.C:
+			return
+		case <-o.stop:
+			return
+		}
+
+		if delay := time.Duration(payloadTimestamp(frame.Meta)-s.startedAt) - time.Since(start); delay > 0 && !o.sleep(delay) {
+			return
+		}
+		f, _, ok := parseWSFrame(frame.Data)
+		if _, truncated := PayloadMetaField(frame.Meta, "truncated"); !ok || truncated {
+			// only the start of the frame was recorded
+			o.stats.Add("dropped", 1)
+			continue
+		}
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		if _, err := conn.Write(appendWSFrame(nil, f, mask)); err != nil {
+			Debug(1, fmt.Sprintf("[HTTP-OUTPUT] WebSocket session %s: %q", s.id, err))
+			return
+		}
+		o.stats.Add("websocket_frames", 1)
+
+		if f.opcode == wsClose {
+			// give the target a chance to answer the close frame
+			select {
+			case <-closed:
+			case <-time.After(o.config.Timeout):
+			}
+			return
+		}
+		idle.Reset(webSocketIdleTimeout)
+	}
+}
+
+// payloadTimestamp returns timing field of the meta
+func payloadTimestamp(meta []byte) int64 {
+	fields := PayloadMeta(meta)
+	if len(fields) < 3 {
+		return 0
+	}
+	ts, _ := strconv.ParseInt(string(fields[2]), 10, 64)
+	return ts
+}
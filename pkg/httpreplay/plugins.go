@@ -1,7 +1,10 @@
 package httpreplay
 
 import (
+	"encoding/json"
+	"fmt"
 	"reflect"
+	"runtime"
 	"strings"
 )
 
@@ -32,6 +35,9 @@ type InOutPlugins struct {
 	Inputs  []PluginReader
 	Outputs []PluginWriter
 	All     []interface{}
+
+	previous *InOutPlugins          // plugins to reuse on reload
+	keys     map[string]interface{} // plugins created by registerPlugin without limiter, see pluginKey
 }
 
 // extractLimitOptions detects if plugin get called with limiter support
@@ -48,28 +54,115 @@ func extractLimitOptions(options string) (string, string) {
 
 // NewPlugins specify and initialize all available plugins
 func NewPlugins() *InOutPlugins {
+	return newPlugins(nil)
+}
+
+// newPlugins creates plugins configured by Settings. Plugins of previous set created with the same options
+// are reused. Inputs can't be added or removed without restart, previous ones are kept.
+func newPlugins(previous *InOutPlugins) *InOutPlugins {
 	plugins := new(InOutPlugins)
+	plugins.previous = previous
+	plugins.keys = make(map[string]interface{})
 
 	for _, options := range Settings.InputFile {
 		plugins.registerPlugin(NewFileInput, options, Settings.InputFileLoop, Settings.InputFileReadDepth, Settings.InputFileMaxWait, Settings.InputFileDryRun)
 	}
 
 	for _, path := range Settings.OutputFile {
-		plugins.registerPlugin(NewFileOutput, path, &Settings.OutputFileConfig)
-
+		// plugins keep the config, so it must not change on reload
+		config := Settings.OutputFileConfig
+		plugins.registerPlugin(NewFileOutput, path, &config)
 	}
 
+	Settings.InputHTTPConfig.BufferSize = Settings.CopyBufferSize
 	for _, options := range Settings.InputHTTP {
-		plugins.registerPlugin(NewHTTPInput, options)
+		plugins.registerPlugin(NewHTTPInput, options, &Settings.InputHTTPConfig)
+	}
+
+	if Settings.OutputCompare != "" {
+		config := Settings.OutputCompareConfig
+		plugins.registerPlugin(NewCompareOutput, Settings.OutputCompare, &config)
 	}
 
 	for _, options := range Settings.OutputHTTP {
 		plugins.registerPlugin(NewHTTPOutput, options, &Settings.OutputHTTPConfig)
 	}
 
+	if previous != nil {
+		kept := make(map[interface{}]bool)
+		for _, p := range plugins.All {
+			kept[unwrapLimiter(p)] = true
+		}
+		for _, p := range previous.All {
+			if kept[unwrapLimiter(p)] || isOutput(p) {
+				continue
+			}
+			key := fmt.Sprintf("%p", unwrapLimiter(p))
+			for k, v := range previous.keys {
+				if v == unwrapLimiter(p) {
+					key = k
+					Debug(0, fmt.Sprintf("[RELOAD] input %s can't be removed or changed without restart", p))
+				}
+			}
+			plugins.addPlugin(key, p)
+		}
+	}
+
+	plugins.previous = nil
 	return plugins
 }
 
+// pluginKey identifies plugin by constructor and options, e.g.
+// "NewHTTPOutput [\"http://staging\",{\"output-http-workers\":10,...}]#0"
+func pluginKey(constructor interface{}, options []interface{}, keys map[string]interface{}) string {
+	name := runtime.FuncForPC(reflect.ValueOf(constructor).Pointer()).Name()
+	data, _ := json.Marshal(options)
+	key := name + " " + string(data)
+	// the same output can be given several times to duplicate traffic
+	for i := 0; ; i++ {
+		if _, ok := keys[fmt.Sprintf("%s#%d", key, i)]; !ok {
+			return fmt.Sprintf("%s#%d", key, i)
+		}
+	}
+}
+
+func isOutput(plugin interface{}) bool {
+	_, ok := unwrapLimiter(plugin).(PluginWriter)
+	return ok
+}
+
+// unwrapLimiter returns plugin wrapped by Limiter
+func unwrapLimiter(plugin interface{}) interface{} {
+	if l, ok := plugin.(*Limiter); ok {
+		return l.plugin
+	}
+	return plugin
+}
+
+// plugin returns registered plugin, which may be Limiter, for plugin without limiter
+func (plugins *InOutPlugins) plugin(p interface{}) interface{} {
+	for _, registered := range plugins.All {
+		if unwrapLimiter(registered) == p {
+			return registered
+		}
+	}
+	return p
+}
+
+func (plugins *InOutPlugins) addPlugin(key string, plugin interface{}) {
+	plugins.keys[key] = unwrapLimiter(plugin)
+
+	// Some of the output can be Readers as well because return responses
+	if r, ok := plugin.(PluginReader); ok {
+		plugins.Inputs = append(plugins.Inputs, r)
+	}
+
+	if w, ok := plugin.(PluginWriter); ok {
+		plugins.Outputs = append(plugins.Outputs, w)
+	}
+	plugins.All = append(plugins.All, plugin)
+}
+
 // Automatically detects type of plugin and initialize it
 //
 // See this article if curious about reflect stuff below: http://blog.burntsushi.net/type-parametric-functions-golang
@@ -91,20 +184,35 @@ func (plugins *InOutPlugins) registerPlugin(constructor interface{}, options ...
 		vo[0] = reflect.ValueOf(path)
 	}
 
-	// Calling our constructor with list of given options
-	plugin := vc.Call(vo)[0].Interface()
-
-	if limit != "" {
-		plugin = NewLimiter(plugin, limit)
+	if len(options) > 0 {
+		options[0] = path
 	}
+	key := pluginKey(constructor, options, plugins.keys)
 
-	// Some of the output can be Readers as well because return responses
-	if r, ok := plugin.(PluginReader); ok {
-		plugins.Inputs = append(plugins.Inputs, r)
+	var plugin interface{}
+	if plugins.previous != nil {
+		plugin = plugins.previous.keys[key]
+	}
+	if plugin == nil {
+		if plugins.previous != nil && !vc.Type().Out(0).Implements(reflect.TypeOf((*PluginWriter)(nil)).Elem()) {
+			Debug(0, fmt.Sprintf("[RELOAD] input %s can't be added without restart", path))
+			return
+		}
+		// Calling our constructor with list of given options
+		plugin = vc.Call(vo)[0].Interface()
 	}
 
-	if w, ok := plugin.(PluginWriter); ok {
-		plugins.Outputs = append(plugins.Outputs, w)
+	if plugins.previous != nil && !isOutput(plugin) {
+		// inputs are kept as they are, the limiter they were started with gets the new limit
+		plugin = plugins.previous.plugin(plugin)
+		if l, ok := plugin.(*Limiter); ok {
+			l.setLimit(limit)
+		} else if limit != "" {
+			Debug(0, fmt.Sprintf("[RELOAD] limit can't be added to input %s without restart", path))
+		}
+	} else if limit != "" {
+		plugin = NewLimiter(plugin, limit)
 	}
-	plugins.All = append(plugins.All, plugin)
+
+	plugins.addPlugin(key, plugin)
 }
@@ -5,6 +5,11 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"httpcopy/pkg/proto"
+	"io/ioutil"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
 )
 
 // These constants help to indicate the type of payload
@@ -12,6 +17,7 @@ const (
 	RequestPayload          = '1'
 	ResponsePayload         = '2'
 	ReplayedResponsePayload = '3'
+	WebSocketPayload        = '4' // frame of WebSocket session, see websocket.go
 )
 
 func randByte(len int) []byte {
@@ -47,10 +53,54 @@ func payloadScanner(data []byte, atEOF bool) (advance int, token []byte, err err
 }
 
 // Timing is request start or round-trip time, depending on payloadType
-func PayloadHeader(payloadType byte, uuid []byte, timing int64, latency int64) (header []byte) {
+// Extras are appended as additional fields, see MetaField. Gor ignores them.
+func PayloadHeader(payloadType byte, uuid []byte, timing int64, latency int64, extras ...string) (header []byte) {
 	//Example:
 	//  3 f45590522cd1838b4a0d5c5aab80b77929dea3b3 13923489726487326 1231\n
-	return []byte(fmt.Sprintf("%c %s %d %d\n", payloadType, uuid, timing, latency))
+	//  1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 13923489726487326 -1 tls=1\n
+	header = []byte(fmt.Sprintf("%c %s %d %d", payloadType, uuid, timing, latency))
+	for _, extra := range extras {
+		header = append(header, ' ')
+		header = append(header, extra...)
+	}
+	return append(header, '\n')
+}
+
+// MetaField formats an extra meta field as key=value, the value is escaped so it never contains spaces
+func MetaField(key, value string) string {
+	return key + "=" + url.QueryEscape(value)
+}
+
+// PayloadMetaAppend adds extra fields to existing meta, see PayloadHeader
+func PayloadMetaAppend(meta []byte, extras ...string) []byte {
+	trimmed := bytes.TrimRight(meta, "\r\n")
+	header := make([]byte, 0, len(meta)+32)
+	header = append(header, trimmed...)
+	if bytes.Count(trimmed, []byte{' '}) < 3 {
+		// extras always follow the latency
+		header = append(header, " -1"...)
+	}
+	for _, extra := range extras {
+		header = append(header, ' ')
+		header = append(header, extra...)
+	}
+	return append(header, '\n')
+}
+
+// PayloadMetaField returns the value of the extra meta field with given key
+func PayloadMetaField(payload []byte, key string) (string, bool) {
+	meta := PayloadMeta(payload)
+	if len(meta) < 4 {
+		return "", false
+	}
+	prefix := []byte(key + "=")
+	for _, field := range meta[4:] {
+		if bytes.HasPrefix(field, prefix) {
+			value, err := url.QueryUnescape(string(field[len(prefix):]))
+			return value, err == nil
+		}
+	}
+	return "", false
 }
 
 func payloadBody(payload []byte) []byte {
@@ -92,3 +142,34 @@ func isOriginPayload(payload []byte) bool {
 func IsRequestPayload(payload []byte) bool {
 	return payload[0] == RequestPayload
 }
+
+func IsWebSocketPayload(payload []byte) bool {
+	return payload[0] == WebSocketPayload
+}
+
+// truncatePayload cuts HTTP payload to limit bytes and keeps it parseable, as HTTPInput does for oversize requests:
+// chunked body is decoded and Content-Length is set to the length of the kept part of the body
+func truncatePayload(data []byte, limit int) []byte {
+	end := proto.MIMEHeadersEndPos(data)
+	if end == -1 || end > limit {
+		// header section alone doesn't fit
+		return data[:limit]
+	}
+	head, body := append([]byte(nil), data[:end]...), data[end:]
+	if bytes.Contains(bytes.ToLower(proto.Header(head, []byte("Transfer-Encoding"))), []byte("chunked")) {
+		// chunks after the limit and trailers are lost, whatever was decoded is kept
+		body, _ = ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		head = proto.DeleteHeader(head, []byte("Transfer-Encoding"))
+		head = proto.DeleteHeader(head, []byte("Trailer"))
+	}
+	for {
+		header := proto.SetHeader(append([]byte(nil), head...), []byte("Content-Length"), []byte(strconv.Itoa(len(body))))
+		if len(header)+len(body) <= limit {
+			return append(header, body...)
+		}
+		if len(header) > limit {
+			return data[:limit]
+		}
+		body = body[:limit-len(header)]
+	}
+}
@@ -0,0 +1,158 @@
+package httpreplay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolTimeout limits how long a connection may take to send its PROXY header
+var proxyProtocolTimeout = 5 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrProxyProtocol is returned for connections without valid PROXY protocol header
+var ErrProxyProtocol = errors.New("invalid PROXY protocol header")
+
+// proxyProtocolListener accepts connections which start with PROXY protocol v1 or v2 header,
+// as sent by haproxy, nginx or AWS load balancers. RemoteAddr of accepted connections is the original client.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+// Accept waits for the next connection, its header is read lazily in the connection goroutine
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remote, c.err = readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			Debug(1, fmt.Sprintf("[INPUT-HTTP] %s from %s", c.err, c.Conn.RemoteAddr()))
+			// reported as read error so that http.Server drops the connection without a response
+			c.err = &net.OpError{Op: "read", Net: "tcp", Source: c.Conn.LocalAddr(), Addr: c.Conn.RemoteAddr(), Err: c.err}
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns address of the client as reported by the proxy
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader consumes PROXY protocol header and returns source address.
+// Address is nil for LOCAL and UNKNOWN connections, e.g. health checks of the proxy itself.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil && len(sig) < 6 {
+		return nil, ErrProxyProtocol
+	}
+	if bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, ErrProxyProtocol
+}
+
+// readProxyProtocolV1 parses text header, e.g. "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrProxyProtocol
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyProtocol
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyProtocol
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, ErrProxyProtocol
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyProtocolV2 parses binary header, TLVs are skipped
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrProxyProtocol
+	}
+	if header[12]>>4 != 2 {
+		return nil, ErrProxyProtocol
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, ErrProxyProtocol
+	}
+
+	// LOCAL command, connection established by the proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, ErrProxyProtocol
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, ErrProxyProtocol
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
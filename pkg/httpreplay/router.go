@@ -0,0 +1,169 @@
+package httpreplay
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"httpcopy/pkg/proto"
+)
+
+// routeTTL is how long responses are routed to the output which received their request
+const routeTTL = 60 * time.Second
+
+// outputRouter splits traffic among outputs when --split-output is enabled.
+// Without a session key outputs are picked in round robin. With a key, e.g. client ip or a cookie,
+// outputs are picked by rendezvous hashing so that all requests of a session land on the same output,
+// even if the set of outputs changes.
+// Responses are sent to the output which received their request.
+type outputRouter struct {
+	mu       sync.Mutex
+	key      string
+	names    []string
+	next     int
+	requests map[string]route
+	gcAt     time.Time
+	// requests are tracked only while responses may follow them:
+	// if outputs return replayed responses, or inputs sent responses within routeTTL
+	replies    bool
+	responseAt time.Time
+}
+
+type route struct {
+	index   int
+	time    time.Time
+	session bool // WebSocket upgrade, its frames follow until the session ends
+}
+
+// responder is implemented by outputs which may return responses of requests written to them
+type responder interface {
+	returnsResponses() bool
+}
+
+// splitRouter returns router configured by --split-output flags, or nil if every output gets all traffic
+func splitRouter(writers []PluginWriter) *outputRouter {
+	if !Settings.SplitOutput || len(writers) == 0 {
+		return nil
+	}
+	key := Settings.SplitOutputKey
+	if key == "" && Settings.RecognizeTCPSessions {
+		key = "ip"
+	}
+	return newOutputRouter(key, writers)
+}
+
+// newOutputRouter creates router for writers. Key is one of "ip", "header:<name>" or "cookie:<name>",
+// empty key means round robin.
+func newOutputRouter(key string, writers []PluginWriter) *outputRouter {
+	if err := checkSplitKey(key); err != nil {
+		log.Fatal("[EMITTER] ", err)
+	}
+
+	// responses of inputs are expected at first, tracking stops if none come within routeTTL
+	r := &outputRouter{key: key, requests: make(map[string]route), gcAt: time.Now(), responseAt: time.Now()}
+	seen := make(map[string]int)
+	for _, w := range writers {
+		if o, ok := unwrapLimiter(w).(responder); ok && o.returnsResponses() {
+			r.replies = true
+		}
+		name := fmt.Sprint(w)
+		r.names = append(r.names, fmt.Sprintf("%s#%d", name, seen[name]))
+		seen[name]++
+	}
+	return r
+}
+
+func checkSplitKey(key string) error {
+	switch {
+	case key == "", key == "ip":
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+	case strings.HasPrefix(key, "cookie:") && len(key) > len("cookie:"):
+	default:
+		return fmt.Errorf("invalid split output key %q, expected ip, header:<name> or cookie:<name>", key)
+	}
+	return nil
+}
+
+// Route returns index of the writer for message
+func (r *outputRouter) Route(msg *Message) int {
+	id := string(PayloadID(msg.Meta))
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.gcAt) > routeTTL {
+		for k, v := range r.requests {
+			if now.Sub(v.time) > routeTTL {
+				delete(r.requests, k)
+			}
+		}
+		r.gcAt = now
+	}
+
+	if !IsRequestPayload(msg.Meta) {
+		if msg.Meta[0] != ReplayedResponsePayload {
+			r.responseAt = now
+		}
+		if rt, ok := r.requests[id]; ok {
+			switch {
+			case IsWebSocketPayload(msg.Meta):
+				rt.time = now
+				r.requests[id] = rt
+			case rt.session:
+			case msg.Meta[0] == ReplayedResponsePayload || !r.replies:
+				// no more responses are expected
+				delete(r.requests, id)
+			}
+			return rt.index
+		}
+	}
+
+	index := -1
+	if session := r.sessionKey(msg); session != "" {
+		index = r.hash(session)
+	} else {
+		index = r.next
+		r.next = (r.next + 1) % len(r.names)
+	}
+
+	if IsRequestPayload(msg.Meta) && (r.replies || now.Sub(r.responseAt) <= routeTTL) {
+		r.requests[id] = route{index, now, isWebSocketRequest(msg.Data)}
+	}
+	return index
+}
+
+// sessionKey extracts value of the configured attribute, empty if there is none
+func (r *outputRouter) sessionKey(msg *Message) string {
+	if !IsRequestPayload(msg.Meta) {
+		return ""
+	}
+	switch {
+	case r.key == "ip":
+		ip, _ := PayloadMetaField(msg.Meta, "ip")
+		return ip
+	case strings.HasPrefix(r.key, "header:"):
+		return string(proto.Header(msg.Data, []byte(r.key[len("header:"):])))
+	case strings.HasPrefix(r.key, "cookie:"):
+		return string(proto.Cookie(msg.Data, []byte(r.key[len("cookie:"):])))
+	}
+	return ""
+}
+
+// hash picks the writer with the highest score for the session
+func (r *outputRouter) hash(session string) (index int) {
+	var max uint64
+	for i, name := range r.names {
+		h := fnv.New64a()
+		h.Write([]byte(session))
+		h.Write([]byte{0})
+		h.Write([]byte(name))
+		if score := h.Sum64(); i == 0 || score > max {
+			max, index = score, i
+		}
+	}
+	return
+}
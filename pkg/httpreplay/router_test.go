@@ -0,0 +1,53 @@
+package httpreplay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutputRouterTracking(t *testing.T) {
+	writers := []PluginWriter{NewTestOutput(nil), NewTestOutput(nil)}
+	message := func(payloadType byte, id, data string) *Message {
+		return &Message{Meta: PayloadHeader(payloadType, []byte(id), 1, -1), Data: []byte(data)}
+	}
+	request := "GET / HTTP/1.1\r\n\r\n"
+
+	// no responses for a while
+	r := newOutputRouter("", writers)
+	r.responseAt = time.Now().Add(-2 * routeTTL)
+	r.Route(message(RequestPayload, "a", request))
+	if len(r.requests) != 0 {
+		t.Error("Requests should not be tracked when no responses are coming")
+	}
+
+	// responses of inputs follow their requests and are forgotten once routed
+	r.Route(message(ResponsePayload, "a", "HTTP/1.1 200 OK\r\n\r\n"))
+	index := r.Route(message(RequestPayload, "b", request))
+	r.Route(message(RequestPayload, "c", request))
+	if r.Route(message(ResponsePayload, "b", "HTTP/1.1 200 OK\r\n\r\n")) != index || len(r.requests) != 1 {
+		t.Errorf("Expected response to follow its request and its route to be deleted: %v", r.requests)
+	}
+
+	// replayed response is the last one when outputs return responses
+	r.replies = true
+	index = r.Route(message(RequestPayload, "d", request))
+	r.Route(message(ResponsePayload, "d", "HTTP/1.1 200 OK\r\n\r\n"))
+	if r.Route(message(ReplayedResponsePayload, "d", "HTTP/1.1 200 OK\r\n\r\n")) != index {
+		t.Error("Replayed response should follow its request")
+	}
+	if _, ok := r.requests["d"]; ok {
+		t.Error("Route should be deleted after replayed response")
+	}
+
+	// WebSocket session is kept while frames come
+	index = r.Route(message(RequestPayload, "e", "GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	r.Route(message(ReplayedResponsePayload, "e", "HTTP/1.1 101 Switching Protocols\r\n\r\n"))
+	for i := 0; i < 3; i++ {
+		if r.Route(message(WebSocketPayload, "e", "")) != index {
+			t.Error("Frames should follow the upgrade request")
+		}
+	}
+	if _, ok := r.requests["e"]; !ok {
+		t.Error("Route of WebSocket session should be kept")
+	}
+}
@@ -1,9 +1,11 @@
 package httpreplay
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"httpcopy/pkg/size"
+	"net/url"
 	"os"
 	"strconv"
 	"sync"
@@ -25,6 +27,14 @@ func (h *MultiOption) String() string {
 	return fmt.Sprint(*h.a)
 }
 
+// Get returns collected values, see flag.Getter
+func (h *MultiOption) Get() interface{} {
+	if h.a == nil {
+		return []string{}
+	}
+	return append([]string{}, *h.a...)
+}
+
 // Set gets called multiple times for each flag with same name
 func (h *MultiOption) Set(value string) error {
 	if h.a == nil {
@@ -48,6 +58,14 @@ func (h *MultiIntOption) String() string {
 	return fmt.Sprint(*h.a)
 }
 
+// Get returns collected values, see flag.Getter
+func (h *MultiIntOption) Get() interface{} {
+	if h.a == nil {
+		return []int{}
+	}
+	return append([]int{}, *h.a...)
+}
+
 // Set gets called multiple times for each flag with same name
 func (h *MultiIntOption) Set(value string) error {
 	if h.a == nil {
@@ -61,15 +79,22 @@ func (h *MultiIntOption) Set(value string) error {
 
 // AppSettings is the struct of main configuration
 type AppSettings struct {
+	Config      string `json:"-"`
+	PrintConfig bool   `json:"-"`
+
 	Verbose   int           `json:"verbose"`
 	Stats     bool          `json:"stats"`
 	ExitAfter time.Duration `json:"exit-after"`
+	// DrainTimeout is how long shutdown waits for outputs to send queued messages
+	DrainTimeout time.Duration `json:"drain-timeout"`
 
 	SplitOutput          bool   `json:"split-output"`
+	SplitOutputKey       string `json:"split-output-key"`
 	RecognizeTCPSessions bool   `json:"recognize-tcp-sessions"`
 	Pprof                string `json:"http-pprof"`
 
 	CopyBufferSize size.Size `json:"copy-buffer-size"`
+	Middleware     string    `json:"middleware"`
 
 	OutputStdout bool `json:"output-stdout"`
 	OutputNull   bool `json:"output-null"`
@@ -82,11 +107,17 @@ type AppSettings struct {
 	OutputFile         []string      `json:"output-file"`
 	OutputFileConfig   FileOutputConfig
 
-	InputHTTP    []string `json:"input-http"`
-	OutputHTTP   []string `json:"output-http"`
-	PrettifyHTTP bool     `json:"prettify-http"`
+	OutputCompare       string `json:"output-compare"`
+	OutputCompareConfig CompareOutputConfig
+
+	InputHTTP       []string `json:"input-http"`
+	InputHTTPConfig HTTPInputConfig
+	OutputHTTP      []string `json:"output-http"`
+	PrettifyHTTP    bool     `json:"prettify-http"`
 
 	OutputHTTPConfig HTTPOutputConfig
+
+	ModifierConfig HTTPModifierConfig
 }
 
 // Settings holds Gor configuration
@@ -100,56 +131,241 @@ func usage() {
 
 func init() {
 	flag.Usage = usage
-	flag.StringVar(&Settings.Pprof, "http-pprof", "", "Enable profiling. Starts  http server on specified port, exposing special /debug/pprof endpoint. Example: `:8181`")
-	flag.IntVar(&Settings.Verbose, "verbose", 0, "set the level of verbosity, if greater than zero then it will turn on debug output")
-	flag.BoolVar(&Settings.Stats, "stats", false, "Turn on queue stats output")
+	registerFlags(flag.CommandLine, &Settings)
+	defaultSettings = Settings
+}
+
+// registerFlags binds flags to fields of settings
+func registerFlags(flags *flag.FlagSet, settings *AppSettings) {
+	flags.StringVar(&settings.Config, "config", "", "Load settings from JSON or YAML file, keys are flag names. Flags and HTTPCOPY_* environment variables, e.g. HTTPCOPY_OUTPUT_HTTP_WORKERS=10, override the file:\n\thttpcopy --config replay.yaml --output-http-workers 10")
+	flags.BoolVar(&settings.PrintConfig, "print-config", false, "Print effective settings merged from --config, environment and flags as JSON, then exit.")
+	flags.StringVar(&settings.Pprof, "http-pprof", "", "Enable profiling. Starts  http server on specified port, exposing special /debug/pprof, /debug/vars and Prometheus /metrics endpoints. Example: `:8181`")
+	flags.IntVar(&settings.Verbose, "verbose", 0, "set the level of verbosity, if greater than zero then it will turn on debug output")
+	flags.BoolVar(&settings.Stats, "stats", false, "Turn on queue stats output")
 
 	if DEMO == "" {
-		flag.DurationVar(&Settings.ExitAfter, "exit-after", 0, "exit after specified duration")
+		flags.DurationVar(&settings.ExitAfter, "exit-after", 0, "exit after specified duration")
 	} else {
-		Settings.ExitAfter = 5 * time.Minute
+		settings.ExitAfter = 5 * time.Minute
 	}
+	flags.DurationVar(&settings.DrainTimeout, "drain-timeout", 10*time.Second, "On exit, wait up to this long for outputs to send queued requests. Messages still queued after that are dropped and reported.")
 
-	flag.BoolVar(&Settings.SplitOutput, "split-output", false, "By default each output gets same traffic. If set to `true` it splits traffic equally among all outputs.")
-	flag.BoolVar(&Settings.RecognizeTCPSessions, "recognize-tcp-sessions", false, "[PRO] If turned on http output will create separate worker for each TCP session. Splitting output will session based as well.")
+	flags.BoolVar(&settings.SplitOutput, "split-output", false, "By default each output gets same traffic. If set to `true` it splits traffic equally among all outputs.")
+	flags.StringVar(&settings.SplitOutputKey, "split-output-key", "", "With --split-output, send all requests with the same value of this attribute to the same output: `ip`, header:<name> or cookie:<name>. Example: --split-output-key header:Authorization")
+	flags.BoolVar(&settings.RecognizeTCPSessions, "recognize-tcp-sessions", false, "Splitting output will be session based, all requests of a client go to the same output. Same as --split-output-key ip")
 
-	flag.BoolVar(&Settings.OutputStdout, "output-stdout", false, "Used for testing inputs. Just prints to console data coming from inputs.")
-	flag.BoolVar(&Settings.OutputNull, "output-null", false, "Used for testing inputs. Drops all requests.")
+	flags.BoolVar(&settings.OutputStdout, "output-stdout", false, "Used for testing inputs. Just prints to console data coming from inputs.")
+	flags.BoolVar(&settings.OutputNull, "output-null", false, "Used for testing inputs. Drops all requests.")
 
 	//input-http flag
-	flag.Var(&MultiOption{&Settings.InputHTTP}, "input-http", "Read requests from file: \n\thttpcopy --input-http :28080[port] --output-http staging.com")
+	flags.Var(&MultiOption{&settings.InputHTTP}, "input-http", "Read requests sent to this address, a port or unix:// socket path: \n\thttpcopy --input-http :28080[port] --output-http staging.com\n\thttpcopy --input-http unix:///run/httpcopy.sock --output-http staging.com")
+	flags.StringVar(&settings.InputHTTPConfig.Upstream, "input-http-upstream", "", "Proxy requests received by --input-http to the given address and record the upstream responses: \n\thttpcopy --input-http :9797 --input-http-upstream http://backend --output-file requests.gor")
+	flags.StringVar(&settings.InputHTTPConfig.TLSCert, "input-http-tls-cert", "", "Serve --input-http over TLS using this certificate file. Changes to the file are picked up without restart.")
+	flags.StringVar(&settings.InputHTTPConfig.TLSKey, "input-http-tls-key", "", "Private key file for --input-http-tls-cert.")
+	flags.StringVar(&settings.InputHTTPConfig.TLSClientCA, "input-http-tls-client-ca", "", "Require clients of --input-http to present a certificate signed by this CA bundle (mutual TLS).")
+	flags.IntVar(&settings.InputHTTPConfig.QueueLen, "input-http-queue-len", 1000, "Number of requests --input-http can hold in memory while outputs are busy.")
+	flags.StringVar(&settings.InputHTTPConfig.Overflow, "input-http-overflow", OverflowBlock, "What --input-http does when its queue is full: `block`, drop-newest, drop-oldest or spill (to a temporary file, see --input-http-spill-dir).")
+	flags.DurationVar(&settings.InputHTTPConfig.BlockTimeout, "input-http-block-timeout", 0, "With --input-http-overflow block, drop the request if it can't be queued within this duration. By default waits forever, or doesn't wait at all with --input-http-upstream, so that proxied traffic isn't held up.")
+	flags.StringVar(&settings.InputHTTPConfig.SpillDir, "input-http-spill-dir", "", "Directory for the --input-http-overflow spill queue. Defaults to the system temporary directory.")
+	flags.BoolVar(&settings.InputHTTPConfig.RejectOversize, "input-http-reject-oversize", false, "Respond with 413 to requests whose body doesn't fit into --copy-buffer-size instead of recording them truncated.")
+	flags.BoolVar(&settings.InputHTTPConfig.OriginalHost, "input-http-original-host", false, "Record the Host the request was mirrored from (X-Original-Host, X-Forwarded-Host or Envoy \"-shadow\" host) instead of the one it was sent to.")
+	flags.BoolVar(&settings.InputHTTPConfig.MirrorHeaders, "input-http-mirror-headers", false, "Trust headers set by the mirroring proxy: X-Original-URI for the request URI, X-Forwarded-For and X-Real-IP for the client address, X-Forwarded-Proto.")
+	flags.BoolVar(&settings.InputHTTPConfig.ProxyProtocol, "input-http-proxy-protocol", false, "Require PROXY protocol v1 or v2 header on --input-http connections and use it as the client address.")
+	flags.Var(&settings.InputHTTPConfig.Responses, "input-http-response", "Answer mirrored requests under the path prefix with the status and body instead of 200 OK, the longest prefix wins. The body is a Go template with .ID, .Method, .Host, .Path, .Query and .Header of the request:\n\thttpcopy --input-http :9797 --output-http staging.com --input-http-response '/webhook:200:{\"id\":\"{{.ID}}\"}' --input-http-response /ping:204")
+	flags.Var(&settings.InputHTTPConfig.ResponseHeaders, "input-http-response-header", "Set header on responses to mirrored requests under the path prefix:\n\thttpcopy --input-http :9797 --output-http staging.com --input-http-response-header \"/webhook:Content-Type: application/json\"")
+	flags.BoolVar(&settings.InputHTTPConfig.RespondAfterQueue, "input-http-respond-after-queue", false, "Answer mirrored requests once they are queued instead of right away, requests dropped by --input-http-overflow get 503.")
+
+	flags.Var(&MultiOption{&settings.InputFile}, "input-file", "Read requests from file: \n\thttpcopy --input-file ./requests.gor --output-http staging.com")
+	flags.BoolVar(&settings.InputFileLoop, "input-file-loop", false, "Loop input files, useful for performance testing.")
+	flags.IntVar(&settings.InputFileReadDepth, "input-file-read-depth", 100, "GoReplay tries to read and cache multiple records, in advance. In parallel it also perform sorting of requests, if they came out of order. Since it needs hold this buffer in memory, bigger values can cause worse performance")
+	flags.BoolVar(&settings.InputFileDryRun, "input-file-dry-run", false, "Simulate reading from the data source without replaying it. You will get information about expected replay time, number of found records etc.")
+	flags.DurationVar(&settings.InputFileMaxWait, "input-file-max-wait", 0, "Set the maximum time between requests. Can help in situations when you have too long periods between request, and you want to skip them. Example: --input-raw-max-wait 1s")
+
+	flags.Var(&MultiOption{&settings.OutputFile}, "output-file", "Write incoming requests to file: \n\thttpcopy --input-raw :80 --output-file ./requests.gor")
+	flags.DurationVar(&settings.OutputFileConfig.FlushInterval, "output-file-flush-interval", 100*time.Millisecond, "Interval for forcing buffer flush to the file.")
+	settings.OutputFileConfig.SizeLimit = 33554432
+	flags.Var(&settings.OutputFileConfig.SizeLimit, "output-file-size-limit", "Size of each chunk. Default: 32mb")
+	settings.OutputFileConfig.OutputFileMaxSize = 1099511627776
+	flags.Var(&settings.OutputFileConfig.OutputFileMaxSize, "output-file-max-size-limit", "Max size of all output files together, records are dropped once it is reached. Default: 1TB")
+	flags.IntVar(&settings.OutputFileConfig.QueueLimit, "output-file-queue-limit", 0, "The number of records per chunk, 0 means no limit.")
+	flags.BoolVar(&settings.OutputFileConfig.Append, "output-file-append", false, "The flushed chunk is appended to existence file or not, chunk limits are not used in this mode.")
+	flags.StringVar(&settings.OutputFileConfig.BufferPath, "output-file-buffer", "", "Directory where chunks are written while they are open, each chunk is moved next to --output-file once complete:\n\thttpcopy --input-http :80 --output-file /mnt/logs/requests.gor --output-file-buffer /tmp")
+
+	flags.BoolVar(&settings.PrettifyHTTP, "prettify-http", false, "If enabled, will automatically decode requests and responses with: Content-Encoding: gzip and Transfer-Encoding: chunked. Useful for debugging, in conjunction with --output-stdout")
+
+	flags.StringVar(&settings.Middleware, "middleware", "", "Used for modifying traffic using external command, compatible with gor middleware. Each message is written to stdin as a hex encoded line, lines written to stdout are sent to outputs. With --output-http-track-response replayed responses are passed to the command as well. Example: --middleware \"./token_rewrite.py --env staging\"")
+	flags.Var(&settings.CopyBufferSize, "copy-buffer-size", "Set the buffer size for an individual request (default 5MB). Larger payloads are truncated and marked with truncated=1 in meta")
+
+	flags.Var(&settings.ModifierConfig.URLRegexp, "http-allow-url", "A regexp to match request URI against. Anything else will be dropped:\n\thttpcopy --input-http :9797 --output-http staging.com --http-allow-url ^/api/")
+	flags.Var(&settings.ModifierConfig.URLNegativeRegexp, "http-disallow-url", "A regexp to match request URI against. Matching requests will be dropped:\n\thttpcopy --input-http :9797 --output-http staging.com --http-disallow-url ^/health")
+	flags.Var(&settings.ModifierConfig.HeaderFilters, "http-allow-header", "A regexp to match a specific header against. Requests with non-matching headers will be dropped:\n\thttpcopy --input-http :9797 --output-http staging.com --http-allow-header api-version:^v1")
+	flags.Var(&settings.ModifierConfig.HeaderNegativeFilters, "http-disallow-header", "A regexp to match a specific header against. Requests with matching headers will be dropped:\n\thttpcopy --input-http :9797 --output-http staging.com --http-disallow-header \"User-Agent: Replayed by Gor\"")
+	flags.Var(&settings.ModifierConfig.Methods, "http-allow-method", "Whitelist of HTTP methods to replay. Anything else will be dropped:\n\thttpcopy --input-http :9797 --output-http staging.com --http-allow-method GET --http-allow-method OPTIONS")
+
+	flags.Var(&settings.ModifierConfig.URLRewrite, "http-rewrite-url", "Rewrite the request URI based on a mapping:\n\thttpcopy --input-http :9797 --output-http staging.com --http-rewrite-url /v1/user/([^\\/]+)/ping:/v2/user/$1/ping")
+	flags.Var(&settings.ModifierConfig.HeaderRewrite, "http-rewrite-header", "Rewrite the request header based on a mapping:\n\thttpcopy --input-http :9797 --output-http staging.com --http-rewrite-header \"Host: (.*).example.com,$1.beta.example.com\"")
+	flags.Var(&settings.ModifierConfig.Headers, "http-set-header", "Inject additional headers to http request:\n\thttpcopy --input-http :9797 --output-http staging.com --http-set-header \"X-Api-Key: staging-key\"")
+	flags.Var(&settings.ModifierConfig.HeadersRemove, "http-remove-header", "Remove headers from http request:\n\thttpcopy --input-http :9797 --output-http staging.com --http-remove-header Authorization")
+	flags.Var(&settings.ModifierConfig.Params, "http-set-param", "Set request url param, if param already exists it will be overwritten:\n\thttpcopy --input-http :9797 --output-http staging.com --http-set-param api_key=1")
+
+	flags.StringVar(&settings.OutputCompare, "output-compare", "", "Compare original responses recorded by inputs with replayed ones, and write mismatches as JSON lines to the report file. Implies --output-http-track-response, requires a single --output-http:\n\thttpcopy --input-file requests.gor --output-http staging.com --output-compare mismatches.jsonl")
+	flags.Var(&MultiOption{&settings.OutputCompareConfig.Headers}, "output-compare-header", "Response header to compare, by default only status and body are compared:\n\t--output-compare-header Content-Type --output-compare-header Cache-Control")
+	flags.Var(&MultiOption{&settings.OutputCompareConfig.Ignore}, "output-compare-ignore", "Path of JSON body value to ignore, * matches any key or array index:\n\t--output-compare-ignore data.updated_at --output-compare-ignore items.*.id")
+	flags.DurationVar(&settings.OutputCompareConfig.Timeout, "output-compare-timeout", time.Minute, "How long to wait for the second response of a pair, unmatched responses are counted as missing")
+
+	flags.Var(&MultiOption{&settings.OutputHTTP}, "output-http", "Forwards incoming requests to given http address or unix:// socket path, see --output-http-socket-host.\n\t# Redirect all incoming requests to staging.com address \n\tgor --input-raw :80 --output-http http://staging.com")
+	flags.BoolVar(&settings.OutputHTTPConfig.TrackResponses, "output-http-track-response", false, "If turned on, HTTP output responses will be set to all outputs like --output-stdout, --output-file or --middleware.")
+	flags.BoolVar(&settings.OutputHTTPConfig.Stats, "output-http-stats", false, "Report http output queue depth and round trip time stats (min, mean, max, p50, p90, p99) to console every N milliseconds, also published as JSON in /debug/vars. See --output-http-stats-ms")
+	flags.IntVar(&settings.OutputHTTPConfig.StatsMs, "output-http-stats-ms", 5000, "Report http output queue stats to console every N milliseconds, at least 1000.")
+	flags.BoolVar(&settings.OutputHTTPConfig.OriginalHost, "output-http-original-host", false, "Normally httpcopy replaces the Host http header with the host supplied with --output-http.  This option disables that behavior, preserving the original Host header.")
+	flags.IntVar(&settings.OutputHTTPConfig.RedirectLimit, "output-http-redirect-limit", 0, "Enable how often redirects should be followed.")
+	flags.IntVar(&settings.OutputHTTPConfig.WorkersMin, "output-http-workers-min", 0, "Gor uses dynamic worker scaling. Enter a number to set a minimum number of workers. default = 1.")
+	flags.IntVar(&settings.OutputHTTPConfig.WorkersMax, "output-http-workers", 0, "Gor uses dynamic worker scaling. Enter a number to set a maximum number of workers. default = 0 = unlimited.")
+	flags.IntVar(&settings.OutputHTTPConfig.QueueLen, "output-http-queue-len", 1000, "Number of requests that can be queued for output, if all workers are busy.")
+	flags.DurationVar(&settings.OutputHTTPConfig.Timeout, "output-http-timeout", time.Second, "Specify HTTP request/response timeout. By default 1s. Example: --output-http-timeout 30s")
+	flags.DurationVar(&settings.OutputHTTPConfig.WorkerTimeout, "output-http-worker-timeout", 2*time.Second, "How long an idle dynamic worker lives before it is stopped.")
+	flags.Var(&settings.OutputHTTPConfig.BufferSize, "output-http-response-buffer", "HTTP response buffer size, all data after this size will be discarded. Responses returned with --output-http-track-response are capped at it and marked with truncated=1 in meta.")
+	flags.BoolVar(&settings.OutputHTTPConfig.SkipVerify, "output-http-skip-verify", false, "Don't verify hostname on TLS secure connection.")
+	flags.StringVar(&settings.OutputHTTPConfig.TLSCert, "output-http-tls-cert", "", "Client certificate for mutual TLS with the target, reloaded when the file changes. Requires --output-http-tls-key:\n\thttpcopy --input-file requests.gor --output-http https://staging --output-http-tls-cert client.crt --output-http-tls-key client.key --output-http-tls-ca ca.crt")
+	flags.StringVar(&settings.OutputHTTPConfig.TLSKey, "output-http-tls-key", "", "Private key of --output-http-tls-cert.")
+	flags.StringVar(&settings.OutputHTTPConfig.TLSCA, "output-http-tls-ca", "", "PEM bundle of CA certificates to verify the target with, instead of the system ones.")
+	flags.StringVar(&settings.OutputHTTPConfig.TLSServerName, "output-http-tls-server-name", "", "Server name sent in SNI and verified in the target certificate, by default the host of --output-http.")
+	flags.StringVar(&settings.OutputHTTPConfig.Proxy, "output-http-proxy", "", "Send requests through proxy, http://, https:// or socks5:// URL. By default HTTP_PROXY and HTTPS_PROXY environment variables are used:\n\thttpcopy --input-file requests.gor --output-http https://staging --output-http-proxy socks5://egress:1080")
+	flags.IntVar(&settings.OutputHTTPConfig.MaxIdleConnsPerHost, "output-http-max-idle-conns-per-host", 0, "Maximum number of idle connections kept to the target. By default 2.")
+	flags.DurationVar(&settings.OutputHTTPConfig.IdleConnTimeout, "output-http-idle-conn-timeout", 0, "How long idle connection is kept. By default 90s.")
+	flags.BoolVar(&settings.OutputHTTPConfig.DisableKeepAlives, "output-http-disable-keep-alive", false, "Open a new connection for every request.")
+	flags.BoolVar(&settings.OutputHTTPConfig.DisableCompression, "output-http-disable-compression", false, "Don't ask the target for gzip compressed responses when the request doesn't.")
+	flags.StringVar(&settings.OutputHTTPConfig.Protocol, "output-http-protocol", "", "Force the protocol used with the target: http1, h2 (HTTP/2 over TLS) or h2c (cleartext HTTP/2 with prior knowledge). By default HTTP/2 is used if an https:// target offers it:\n\thttpcopy --input-file requests.gor --output-http http://staging:8080 --output-http-protocol h2c")
+	flags.StringVar(&settings.OutputHTTPConfig.SocketHost, "output-http-socket-host", "", "Host header of requests sent to unix:// socket given to --output-http, by default localhost:\n\thttpcopy --input-file requests.gor --output-http unix:///run/app.sock --output-http-socket-host app.internal")
+	flags.IntVar(&settings.OutputHTTPConfig.RetryAttempts, "output-http-retry-attempts", 1, "Maximum number of attempts to send a request, 1 disables retries:\n\thttpcopy --input-file requests.gor --output-http staging.com --output-http-retry-attempts 5")
+	flags.DurationVar(&settings.OutputHTTPConfig.RetryBackoff, "output-http-retry-backoff", 100*time.Millisecond, "Delay before the first retry, doubled for every next one. A random jitter of up to half of the delay is applied.")
+	flags.DurationVar(&settings.OutputHTTPConfig.RetryMaxBackoff, "output-http-retry-max-backoff", 10*time.Second, "Maximum delay between retries, also caps Retry-After of 429 responses.")
+	flags.Var(&MultiOption{&settings.OutputHTTPConfig.RetryOn}, "output-http-retry-on", "Retry requests on error (connection errors), timeout, 5xx or 429 responses, all of them by default:\n\thttpcopy --input-file requests.gor --output-http staging.com --output-http-retry-attempts 3 --output-http-retry-on timeout --output-http-retry-on 5xx")
+	flags.BoolVar(&settings.OutputHTTPConfig.Adaptive, "output-http-adaptive", false, "Adjust number of workers to the target: start with --output-http-workers-min, add a worker per round of successful requests and cut by 10% on errors or slow responses, up to --output-http-workers.")
+	flags.DurationVar(&settings.OutputHTTPConfig.AdaptiveLatency, "output-http-adaptive-latency", 0, "With --output-http-adaptive, responses slower than this reduce number of workers as errors do. By default only errors do.")
+	flags.Float64Var(&settings.OutputHTTPConfig.BreakerErrorRate, "output-http-breaker-error-rate", 0, "Stop sending requests to the target once this share of requests fails within --output-http-breaker-window, e.g. 0.5. Requests are rejected and written to --output-http-dead-letter until a trial request succeeds after --output-http-breaker-cooldown.")
+	flags.IntVar(&settings.OutputHTTPConfig.BreakerMinRequests, "output-http-breaker-min-requests", 20, "Minimum number of requests within the window before the circuit breaker may open.")
+	flags.DurationVar(&settings.OutputHTTPConfig.BreakerWindow, "output-http-breaker-window", 10*time.Second, "Window in which the circuit breaker counts the error rate.")
+	flags.DurationVar(&settings.OutputHTTPConfig.BreakerCooldown, "output-http-breaker-cooldown", 30*time.Second, "How long the circuit breaker stays open before a trial request.")
+	flags.StringVar(&settings.OutputHTTPConfig.DeadLetter, "output-http-dead-letter", "", "Write requests which failed after all attempts to this file, it can be replayed later with --input-file. Connection errors and timeouts are always written, 5xx and 429 responses only once --output-http-retry-attempts above 1 are used up.")
 
-	flag.Var(&MultiOption{&Settings.InputFile}, "input-file", "Read requests from file: \n\thttpcopy --input-file ./requests.gor --output-http staging.com")
-	flag.BoolVar(&Settings.InputFileLoop, "input-file-loop", false, "Loop input files, useful for performance testing.")
-	flag.IntVar(&Settings.InputFileReadDepth, "input-file-read-depth", 100, "GoReplay tries to read and cache multiple records, in advance. In parallel it also perform sorting of requests, if they came out of order. Since it needs hold this buffer in memory, bigger values can cause worse performance")
-	flag.BoolVar(&Settings.InputFileDryRun, "input-file-dry-run", false, "Simulate reading from the data source without replaying it. You will get information about expected replay time, number of found records etc.")
-	flag.DurationVar(&Settings.InputFileMaxWait, "input-file-max-wait", 0, "Set the maximum time between requests. Can help in situations when you have too long periods between request, and you want to skip them. Example: --input-raw-max-wait 1s")
-
-	flag.Var(&MultiOption{&Settings.OutputFile}, "output-file", "Write incoming requests to file: \n\thttpcopy --input-raw :80 --output-file ./requests.gor")
-
-	flag.BoolVar(&Settings.PrettifyHTTP, "prettify-http", false, "If enabled, will automatically decode requests and responses with: Content-Encoding: gzip and Transfer-Encoding: chunked. Useful for debugging, in conjunction with --output-stdout")
-
-	flag.Var(&Settings.CopyBufferSize, "copy-buffer-size", "Set the buffer size for an individual request (default 5MB)")
+	// default values, using for tests
+	settings.CopyBufferSize = 5242880
+}
 
-	flag.Var(&MultiOption{&Settings.OutputHTTP}, "output-http", "Forwards incoming requests to given http address.\n\t# Redirect all incoming requests to staging.com address \n\tgor --input-raw :80 --output-http http://staging.com")
+// CheckSettings fills in defaults and returns error for invalid or conflicting settings
+func CheckSettings() error {
+	return checkSettings(&Settings)
+}
 
-	// default values, using for tests
-	Settings.OutputFileConfig.SizeLimit = 33554432
-	Settings.OutputFileConfig.OutputFileMaxSize = 1099511627776
-	Settings.CopyBufferSize = 5242880
+func checkSettings(settings *AppSettings) error {
+	if err := checkOutputHTTPConfig(&settings.OutputHTTPConfig); err != nil {
+		return err
+	}
+	if err := checkOutputFileConfig(&settings.OutputFileConfig); err != nil {
+		return err
+	}
+	if settings.OutputCompare != "" {
+		if settings.SplitOutput {
+			return errors.New("--output-compare needs all traffic and can't be used with --split-output")
+		}
+		// responses are paired by request id, so they must be replayed by a single output
+		if len(settings.OutputHTTP) > 1 {
+			return errors.New("--output-compare can't be used with more than one --output-http")
+		}
+		// comparator is useless without replayed responses
+		settings.OutputHTTPConfig.TrackResponses = true
+	}
 
+	if settings.OutputFileConfig.SizeLimit < 1 {
+		settings.OutputFileConfig.SizeLimit.Set("32mb")
+	}
+	if settings.OutputFileConfig.OutputFileMaxSize < 1 {
+		settings.OutputFileConfig.OutputFileMaxSize.Set("1tb")
+	}
+	if settings.CopyBufferSize < 1 {
+		settings.CopyBufferSize.Set("5mb")
+	}
+	return nil
 }
 
-func CheckSettings() {
-	if Settings.OutputFileConfig.SizeLimit < 1 {
-		Settings.OutputFileConfig.SizeLimit.Set("32mb")
+func checkOutputHTTPConfig(config *HTTPOutputConfig) error {
+	switch {
+	case config.WorkersMin < 0 || config.WorkersMax < 0:
+		return errors.New("--output-http-workers-min and --output-http-workers can't be negative")
+	case config.WorkersMax > 0 && config.WorkersMin > config.WorkersMax:
+		return fmt.Errorf("--output-http-workers-min %d is greater than --output-http-workers %d", config.WorkersMin, config.WorkersMax)
+	case config.QueueLen < 0:
+		return errors.New("--output-http-queue-len can't be negative")
+	case config.RedirectLimit < 0:
+		return errors.New("--output-http-redirect-limit can't be negative")
+	case config.Timeout < 0 || config.WorkerTimeout < 0:
+		return errors.New("--output-http-timeout and --output-http-worker-timeout can't be negative")
+	case config.BufferSize < 0:
+		return errors.New("--output-http-response-buffer can't be negative")
+	case config.Stats && config.StatsMs < 1000:
+		return fmt.Errorf("--output-http-stats-ms %d is too small, stats are reported at most once a second", config.StatsMs)
+	case config.RetryAttempts < 0:
+		return errors.New("--output-http-retry-attempts can't be negative")
+	case config.RetryBackoff < 0 || config.RetryMaxBackoff < 0:
+		return errors.New("--output-http-retry-backoff and --output-http-retry-max-backoff can't be negative")
+	case config.RetryMaxBackoff > 0 && config.RetryBackoff > config.RetryMaxBackoff:
+		return fmt.Errorf("--output-http-retry-backoff %s is greater than --output-http-retry-max-backoff %s", config.RetryBackoff, config.RetryMaxBackoff)
+	case (config.TLSCert == "") != (config.TLSKey == ""):
+		return errors.New("--output-http-tls-cert and --output-http-tls-key should be given together")
+	case config.MaxIdleConnsPerHost < 0 || config.IdleConnTimeout < 0:
+		return errors.New("--output-http-max-idle-conns-per-host and --output-http-idle-conn-timeout can't be negative")
+	case config.AdaptiveLatency < 0:
+		return errors.New("--output-http-adaptive-latency can't be negative")
+	case config.BreakerErrorRate < 0 || config.BreakerErrorRate > 1:
+		return fmt.Errorf("--output-http-breaker-error-rate %v should be between 0 and 1", config.BreakerErrorRate)
+	case config.BreakerMinRequests < 0 || config.BreakerWindow < 0 || config.BreakerCooldown < 0:
+		return errors.New("--output-http-breaker-min-requests, --output-http-breaker-window and --output-http-breaker-cooldown can't be negative")
+	}
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid --output-http-proxy: %v", err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("--output-http-proxy %q should be http://, https:// or socks5:// URL", config.Proxy)
+		}
+	}
+	switch config.Protocol {
+	case "", ProtocolHTTP1, ProtocolH2, ProtocolH2C:
+	default:
+		return fmt.Errorf("unknown --output-http-protocol %q, expected http1, h2 or h2c", config.Protocol)
+	}
+	for _, condition := range config.RetryOn {
+		switch condition {
+		case RetryOnError, RetryOnTimeout, RetryOn5xx, RetryOn429:
+		default:
+			return fmt.Errorf("unknown --output-http-retry-on %q, expected one of %v", condition, retryConditions)
+		}
 	}
-	if Settings.OutputFileConfig.OutputFileMaxSize < 1 {
-		Settings.OutputFileConfig.OutputFileMaxSize.Set("1tb")
+	return nil
+}
+
+func checkOutputFileConfig(config *FileOutputConfig) error {
+	switch {
+	case config.FlushInterval < 0:
+		return errors.New("--output-file-flush-interval can't be negative")
+	case config.QueueLimit < 0:
+		return errors.New("--output-file-queue-limit can't be negative")
+	case config.SizeLimit < 0 || config.OutputFileMaxSize < 0:
+		return errors.New("--output-file-size-limit and --output-file-max-size-limit can't be negative")
+	// values may come from --config or environment too, so the default size limit is the only one allowed
+	case config.Append && (config.QueueLimit > 0 || config.SizeLimit > 0 && config.SizeLimit != defaultSettings.OutputFileConfig.SizeLimit):
+		return errors.New("--output-file-append writes a single file, it can't be used with --output-file-queue-limit or --output-file-size-limit")
 	}
-	if Settings.CopyBufferSize < 1 {
-		Settings.CopyBufferSize.Set("5mb")
+	if config.BufferPath != "" {
+		if stat, err := os.Stat(config.BufferPath); err != nil || !stat.IsDir() {
+			return fmt.Errorf("--output-file-buffer %q is not a directory", config.BufferPath)
+		}
 	}
+	return nil
 }
 
 var previousDebugTime = time.Now()
@@ -157,7 +373,10 @@ var debugMutex sync.Mutex
 
 // Debug take an effect only if --verbose greater than 0 is specified
 func Debug(level int, args ...interface{}) {
-	if Settings.Verbose >= level {
+	settingsMu.RLock()
+	verbose := Settings.Verbose
+	settingsMu.RUnlock()
+	if verbose >= level {
 		debugMutex.Lock()
 		defer debugMutex.Unlock()
 		now := time.Now()
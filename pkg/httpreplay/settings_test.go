@@ -0,0 +1,69 @@
+package httpreplay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckOutputHTTPConfig(t *testing.T) {
+	tests := []struct {
+		config HTTPOutputConfig
+		valid  bool
+	}{
+		{HTTPOutputConfig{}, true},
+		{HTTPOutputConfig{WorkersMin: 10, WorkersMax: 20, Stats: true, StatsMs: 1000}, true},
+		{HTTPOutputConfig{WorkersMin: 10}, true},
+		{HTTPOutputConfig{WorkersMin: 20, WorkersMax: 10}, false},
+		{HTTPOutputConfig{WorkersMax: -1}, false},
+		{HTTPOutputConfig{Timeout: -time.Second}, false},
+		{HTTPOutputConfig{Stats: true, StatsMs: 100}, false},
+		{HTTPOutputConfig{RetryAttempts: 3, RetryOn: []string{RetryOn5xx, RetryOn429}}, true},
+		{HTTPOutputConfig{RetryOn: []string{"4xx"}}, false},
+		{HTTPOutputConfig{RetryBackoff: 2 * time.Second, RetryMaxBackoff: time.Second}, false},
+		{HTTPOutputConfig{Adaptive: true, BreakerErrorRate: 0.5}, true},
+		{HTTPOutputConfig{BreakerErrorRate: 1.5}, false},
+		{HTTPOutputConfig{TLSCert: "client.crt", TLSKey: "client.key", Proxy: "socks5://egress:1080"}, true},
+		{HTTPOutputConfig{TLSCert: "client.crt"}, false},
+		{HTTPOutputConfig{Proxy: "ftp://egress"}, false},
+		{HTTPOutputConfig{Protocol: ProtocolH2C}, true},
+		{HTTPOutputConfig{Protocol: "h3"}, false},
+	}
+	for _, tt := range tests {
+		if err := checkOutputHTTPConfig(&tt.config); (err == nil) != tt.valid {
+			t.Errorf("Expected %+v valid to be %v, got %v", tt.config, tt.valid, err)
+		}
+	}
+}
+
+func TestCheckOutputFileConfig(t *testing.T) {
+	if err := checkOutputFileConfig(&FileOutputConfig{Append: true, SizeLimit: defaultSettings.OutputFileConfig.SizeLimit}); err != nil {
+		t.Error("Default size limit should not conflict with append:", err)
+	}
+	if err := checkOutputFileConfig(&FileOutputConfig{BufferPath: "/nonexistent"}); err == nil {
+		t.Error("Expected error for missing buffer directory")
+	}
+
+	// limits may come from --config or environment as well as from flags
+	if err := checkOutputFileConfig(&FileOutputConfig{Append: true, QueueLimit: 10}); err == nil {
+		t.Error("Expected error for --output-file-append with --output-file-queue-limit")
+	}
+	if err := checkOutputFileConfig(&FileOutputConfig{Append: true, SizeLimit: 1024}); err == nil {
+		t.Error("Expected error for --output-file-append with --output-file-size-limit")
+	}
+}
+
+func TestCheckSettingsOutputCompare(t *testing.T) {
+	defer func(settings AppSettings) { Settings = settings }(Settings)
+
+	Settings = defaultSettings
+	Settings.OutputCompare = "mismatches.jsonl"
+	Settings.OutputHTTP = []string{"http://staging"}
+	if err := CheckSettings(); err != nil || !Settings.OutputHTTPConfig.TrackResponses {
+		t.Errorf("Expected --output-compare to enable --output-http-track-response, got %v", err)
+	}
+
+	Settings.OutputHTTP = append(Settings.OutputHTTP, "http://canary")
+	if err := CheckSettings(); err == nil {
+		t.Error("Expected error for --output-compare with two --output-http")
+	}
+}
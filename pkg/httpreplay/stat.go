@@ -1,56 +1,301 @@
 package httpreplay
 
 import (
+	"expvar"
 	"fmt"
+	"math/bits"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 )
 
+// histogramSubBucketBits sets precision of GorStat percentiles: values are grouped into
+// 2^bits buckets per power of two, so a percentile is within 1/2^bits (~3%) of the exact value
+const histogramSubBucketBits = 5
+
+// GorStat collects values such as queue depth or round trip time, and every rateMs reports
+// latest, min, mean, max and percentiles of the values written during the interval.
+// The last report is published in expvar "stats" map, see Snapshot.
 type GorStat struct {
-	statName string
-	rateMs   int
-	latest   int
-	mean     int
-	max      int
-	count    int
+	mu        sync.Mutex
+	statName  string
+	rateMs    int
+	latest    int
+	min       int
+	max       int
+	sum       int64
+	count     int
+	histogram []int64
+	last      GorStatSnapshot
+	stop      chan struct{}
+}
+
+// GorStatSnapshot holds distribution of values written during one reporting interval
+type GorStatSnapshot struct {
+	Latest     int     `json:"latest"`
+	Min        int     `json:"min"`
+	Mean       int     `json:"mean"`
+	Max        int     `json:"max"`
+	P50        int     `json:"p50"`
+	P90        int     `json:"p90"`
+	P99        int     `json:"p99"`
+	Count      int     `json:"count"`
+	Rate       float64 `json:"count_per_second"`
+	Goroutines int     `json:"goroutines"`
 }
 
 func NewGorStat(statName string, rateMs int) (s *GorStat) {
 	s = new(GorStat)
 	s.statName = statName
 	s.rateMs = rateMs
-	s.latest = 0
-	s.mean = 0
-	s.max = 0
-	s.count = 0
+	s.stop = make(chan struct{})
+
+	expvarMap("stats").Set(statName, expvar.Func(func() interface{} {
+		return s.Snapshot()
+	}))
 
 	go s.reportStats()
 
 	return
 }
 
+// Write adds value to the current interval, negative values are counted as 0
 func (s *GorStat) Write(latest int) {
+	if latest < 0 {
+		latest = 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count == 0 || latest < s.min {
+		s.min = latest
+	}
+	if latest > s.max {
+		s.max = latest
+	}
 	s.latest = latest
-	s.count = s.count + 1
+	s.sum += int64(latest)
+	s.count++
+
+	i := histogramIndex(latest)
+	if i >= len(s.histogram) {
+		s.histogram = append(s.histogram, make([]int64, i+1-len(s.histogram))...)
+	}
+	s.histogram[i]++
 }
 
+// Reset starts a new interval
 func (s *GorStat) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+}
+
+func (s *GorStat) reset() {
 	s.latest = 0
+	s.min = 0
 	s.max = 0
-	s.mean = 0
+	s.sum = 0
 	s.count = 0
+	for i := range s.histogram {
+		s.histogram[i] = 0
+	}
+}
+
+// collect finishes the current interval and returns its snapshot
+func (s *GorStat) collect(interval time.Duration) GorStatSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := GorStatSnapshot{
+		Latest:     s.latest,
+		Min:        s.min,
+		Max:        s.max,
+		Count:      s.count,
+		Rate:       float64(s.count) / interval.Seconds(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	if s.count > 0 {
+		snapshot.Mean = int(s.sum / int64(s.count))
+		snapshot.P50 = s.percentile(50)
+		snapshot.P90 = s.percentile(90)
+		snapshot.P99 = s.percentile(99)
+	}
+	s.last = snapshot
+	s.reset()
+	return snapshot
+}
+
+// percentile returns the highest value of the bucket holding the given percentile, capped by max
+func (s *GorStat) percentile(p float64) int {
+	rank := int64(float64(s.count)*p/100 + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range s.histogram {
+		seen += n
+		if seen >= rank {
+			if v := histogramValue(i); v < s.max {
+				return v
+			}
+			return s.max
+		}
+	}
+	return s.max
+}
+
+// Snapshot returns statistics of the last reported interval
+func (s *GorStat) Snapshot() GorStatSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
 }
 
 func (s *GorStat) String() string {
-	return s.statName + ":" + strconv.Itoa(s.latest) + "," + strconv.Itoa(s.mean) + "," + strconv.Itoa(s.max) + "," + strconv.Itoa(s.count) + "," + strconv.Itoa(s.count/(s.rateMs/1000.0)) + "," + strconv.Itoa(runtime.NumGoroutine())
+	last := s.Snapshot()
+	values := []int{last.Latest, last.Min, last.Mean, last.Max, last.P50, last.P90, last.P99, last.Count}
+	line := s.statName + ":"
+	for _, v := range values {
+		line += strconv.Itoa(v) + ","
+	}
+	return line + strconv.FormatFloat(last.Rate, 'f', 1, 64) + "," + strconv.Itoa(last.Goroutines)
 }
 
 func (s *GorStat) reportStats() {
-	fmt.Println(0, "\n", s.statName+":latest,mean,max,count,count/second,gcount")
+	interval := time.Duration(s.rateMs) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	Debug(0, s.statName+":latest,min,mean,max,p50,p90,p99,count,count/second,gcount")
 	for {
-		fmt.Println(0, "\n", s)
-		s.Reset()
-		time.Sleep(time.Duration(s.rateMs) * time.Millisecond)
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		s.collect(interval)
+		Debug(0, s.String())
 	}
 }
+
+// Close stops reporting
+func (s *GorStat) Close() {
+	close(s.stop)
+}
+
+// histogramIndex returns bucket of value: values below 2^(bits+1) have their own bucket,
+// larger ones share a bucket with values differing only in bits below the top bits+1
+func histogramIndex(v int) int {
+	const subBuckets = 1 << histogramSubBucketBits
+	if v < 2*subBuckets {
+		return v
+	}
+	shift := bits.Len64(uint64(v)) - histogramSubBucketBits - 1
+	return shift*subBuckets + v>>shift
+}
+
+// histogramValue returns the highest value of the bucket
+func histogramValue(i int) int {
+	const subBuckets = 1 << histogramSubBucketBits
+	if i < 2*subBuckets {
+		return i
+	}
+	shift := i/subBuckets - 1
+	return (i-shift*subBuckets)<<shift + 1<<shift - 1
+}
+
+// expvarMap returns the published map with given name, creating it if needed.
+// Plugins may be created several times for the same address, while expvar.NewMap panics on duplicates.
+func expvarMap(name string) *expvar.Map {
+	if m, ok := expvar.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	return expvar.NewMap(name)
+}
+
+// statsInterval is how often --stats reports plugin throughput
+var statsInterval = 5 * time.Second
+
+var pluginStatsMu sync.Mutex
+
+// pluginStats returns counters of messages and bytes passed through the plugin, published in expvar "plugins" map
+func pluginStats(plugin interface{}) *expvar.Map {
+	name := fmt.Sprint(plugin)
+	pluginStatsMu.Lock()
+	defer pluginStatsMu.Unlock()
+	plugins := expvarMap("plugins")
+	if m, ok := plugins.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map)
+	plugins.Set(name, m)
+
+	for _, direction := range []string{"read", "written"} {
+		direction := direction
+		metrics.CounterFunc("httpcopy_plugin_messages_total", "Messages read from or written to the plugin.", func() float64 {
+			return float64(expvarInt(m, direction))
+		}, "plugin", name, "direction", direction)
+		metrics.CounterFunc("httpcopy_plugin_bytes_total", "Bytes of messages read from or written to the plugin.", func() float64 {
+			return float64(expvarInt(m, direction+"_bytes"))
+		}, "plugin", name, "direction", direction)
+	}
+	return m
+}
+
+// countMessage adds message to "read" or "written" counters of plugin
+func countMessage(stats *expvar.Map, direction string, msg *Message) {
+	stats.Add(direction, 1)
+	stats.Add(direction+"_bytes", int64(len(msg.Meta)+len(msg.Data)))
+}
+
+// reportPluginStats prints throughput of every plugin since the previous report until stop is closed
+func reportPluginStats(stop chan struct{}) {
+	previous := make(map[string]int64)
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		expvarMap("plugins").Do(func(plugin expvar.KeyValue) {
+			stats, ok := plugin.Value.(*expvar.Map)
+			if !ok {
+				return
+			}
+			for _, direction := range []string{"read", "written"} {
+				count, bytes := expvarInt(stats, direction), expvarInt(stats, direction+"_bytes")
+				key := plugin.Key + " " + direction
+				if count == previous[key] {
+					continue
+				}
+				seconds := statsInterval.Seconds()
+				Debug(0, fmt.Sprintf("[STATS] %s: %s %.1f msg/s, %.1f KB/s, total %d", plugin.Key, direction,
+					float64(count-previous[key])/seconds, float64(bytes-previous[key+"_bytes"])/1024/seconds, count))
+				previous[key], previous[key+"_bytes"] = count, bytes
+			}
+		})
+	}
+}
+
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// expvarSummary returns integer counters of the map
+func expvarSummary(m *expvar.Map) map[string]int64 {
+	summary := make(map[string]int64)
+	m.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			summary[kv.Key] = v.Value()
+		}
+	})
+	return summary
+}
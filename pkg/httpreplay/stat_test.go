@@ -0,0 +1,59 @@
+package httpreplay
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGorStatPercentiles(t *testing.T) {
+	s := NewGorStat("test_percentiles", 3600*1000)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for v := w + 1; v <= 1000; v += 4 {
+				s.Write(v)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	snapshot := s.collect(time.Second)
+	if snapshot.Min != 1 || snapshot.Max != 1000 || snapshot.Mean != 500 || snapshot.Count != 1000 || snapshot.Rate != 1000 {
+		t.Errorf("Unexpected min, max, mean or count: %+v", snapshot)
+	}
+	for _, p := range []struct{ value, expected int }{
+		{snapshot.P50, 500},
+		{snapshot.P90, 900},
+		{snapshot.P99, 990},
+	} {
+		if p.value < p.expected || p.value > p.expected*103/100 {
+			t.Errorf("Percentile should be within 3%% of %d, got %d", p.expected, p.value)
+		}
+	}
+
+	var published GorStatSnapshot
+	json.Unmarshal([]byte(expvar.Get("stats").(*expvar.Map).Get("test_percentiles").String()), &published)
+	if published != snapshot {
+		t.Errorf("Last interval should be published as JSON: %+v", published)
+	}
+
+	if next := s.collect(time.Second); next.Count != 0 || next.Max != 0 {
+		t.Errorf("Interval should be reset after report: %+v", next)
+	}
+}
+
+func TestGorStatHistogramBuckets(t *testing.T) {
+	for _, v := range []int{0, 1, 63, 64, 65, 100, 1000, 123456789} {
+		high := histogramValue(histogramIndex(v))
+		if high < v || float64(high-v) > float64(v)/(1<<histogramSubBucketBits) {
+			t.Errorf("Bucket of %d ends at %d", v, high)
+		}
+	}
+}
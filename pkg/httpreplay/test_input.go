@@ -28,19 +28,25 @@ func NewTestInput() (i *TestInput) {
 // PluginRead reads message from this plugin
 func (i *TestInput) PluginRead() (*Message, error) {
 	var msg Message
+	var buf []byte
 	select {
-	case buf := <-i.data:
-		msg.Data = buf
-		if !i.skipHeader {
-			msg.Meta = PayloadHeader(RequestPayload, Uuid(), time.Now().UnixNano(), -1)
-		} else {
-			msg.Meta, msg.Data = PayloadMetaWithBody(msg.Data)
+	case buf = <-i.data:
+	case <-i.stop:
+		// data emitted before Close is still delivered
+		select {
+		case buf = <-i.data:
+		default:
+			return nil, ErrorStopped
 		}
+	}
 
-		return &msg, nil
-	case <-i.stop:
-		return nil, ErrorStopped
+	msg.Data = buf
+	if !i.skipHeader {
+		msg.Meta = PayloadHeader(RequestPayload, Uuid(), time.Now().UnixNano(), -1)
+	} else {
+		msg.Meta, msg.Data = PayloadMetaWithBody(msg.Data)
 	}
+	return &msg, nil
 }
 
 // Close closes this plugin
@@ -0,0 +1,116 @@
+package httpreplay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often certificate files are checked for changes
+var tlsReloadInterval = time.Second
+
+// tlsReloader serves a certificate and optional client CA bundle, reloading them when the files change on disk
+type tlsReloader struct {
+	mu        sync.Mutex
+	certFile  string
+	keyFile   string
+	caFile    string
+	config    *tls.Config
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newTLSReloader(certFile, keyFile, caFile string) (*tlsReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both certificate and key files are required")
+	}
+	r := &tlsReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns server configuration which picks up reloaded certificates on each handshake
+func (r *tlsReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+func (r *tlsReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) >= tlsReloadInterval {
+		r.checkedAt = time.Now()
+		if r.lastModified().After(r.modTime) {
+			if err := r.reloadLocked(); err != nil {
+				Debug(0, fmt.Sprintf("[TLS] keeping previous certificate, reload failed: %q", err))
+			}
+		}
+	}
+
+	return r.config
+}
+
+func (r *tlsReloader) lastModified() (latest time.Time) {
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		if stat, err := os.Stat(name); err == nil && stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+	return
+}
+
+func (r *tlsReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked()
+}
+
+func (r *tlsReloader) reloadLocked() error {
+	modTime := r.lastModified()
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	// h2 is offered in ALPN so that servers using the config accept HTTP/2
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+
+	if r.caFile != "" {
+		if config.ClientCAs, err = loadCertPool(r.caFile); err != nil {
+			return err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.config = config
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return nil
+}
+
+// loadCertPool reads PEM encoded certificates from file
+func loadCertPool(name string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", name)
+	}
+	return pool, nil
+}
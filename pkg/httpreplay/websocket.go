@@ -0,0 +1,317 @@
+package httpreplay
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"httpcopy/pkg/proto"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebSocket sessions are recorded as the upgrade request followed by a WebSocketPayload record per frame.
+// Frame records carry the id of the upgrade request, so the whole session is routed and filtered together,
+// dir=client or dir=server and opcode meta fields, fin=0 for non-final fragments,
+// and the frame in wire format without masking as data. Timing is the time the frame was seen.
+// Frames which don't fit --copy-buffer-size are recorded with the start of the payload and truncated=1.
+
+// webSocketGUID is appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept, see RFC 6455
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsFrame is a single WebSocket frame with unmasked payload
+type wsFrame struct {
+	fin       bool
+	opcode    byte
+	payload   []byte
+	truncated bool // payload is the start of a frame larger than the recording limit
+}
+
+// isWebSocketUpgrade reports whether request headers ask to switch to WebSocket
+func isWebSocketUpgrade(header http.Header) bool {
+	if !strings.EqualFold(header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketAccept returns Sec-WebSocket-Accept for the client key
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parseWSHeader parses frame header at the start of buf, n is the header length.
+// ok is false while buf doesn't hold the whole header.
+func parseWSHeader(buf []byte) (f wsFrame, n int, length uint64, mask []byte, ok bool) {
+	if len(buf) < 2 {
+		return f, 0, 0, nil, false
+	}
+	f.fin = buf[0]&0x80 != 0
+	f.opcode = buf[0] & 0x0f
+	masked := buf[1]&0x80 != 0
+	length = uint64(buf[1] & 0x7f)
+	n = 2
+	switch length {
+	case 126:
+		if len(buf) < 4 {
+			return f, 0, 0, nil, false
+		}
+		length, n = uint64(binary.BigEndian.Uint16(buf[2:])), 4
+	case 127:
+		if len(buf) < 10 {
+			return f, 0, 0, nil, false
+		}
+		length, n = binary.BigEndian.Uint64(buf[2:]), 10
+	}
+	if masked {
+		if len(buf) < n+4 {
+			return f, 0, 0, nil, false
+		}
+		mask, n = buf[n:n+4], n+4
+	}
+	return f, n, length, mask, true
+}
+
+// parseWSFrame parses frame at the start of buf and unmasks its payload.
+// ok is false while buf doesn't hold the whole frame.
+func parseWSFrame(buf []byte) (f wsFrame, n int, ok bool) {
+	f, n, length, mask, ok := parseWSHeader(buf)
+	if !ok || uint64(len(buf)-n) < length {
+		return f, 0, false
+	}
+	f.payload = unmaskWS(buf[n:n+int(length)], mask)
+	return f, n + int(length), true
+}
+
+// unmaskWS returns copy of payload unmasked with mask, which may be nil
+func unmaskWS(payload, mask []byte) []byte {
+	unmasked := make([]byte, len(payload))
+	copy(unmasked, payload)
+	if mask != nil {
+		for i := range unmasked {
+			unmasked[i] ^= mask[i%4]
+		}
+	}
+	return unmasked
+}
+
+// appendWSFrame appends frame in wire format to dst, the payload is masked with mask unless it is nil
+func appendWSFrame(dst []byte, f wsFrame, mask []byte) []byte {
+	first := f.opcode
+	if f.fin {
+		first |= 0x80
+	}
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+
+	length := len(f.payload)
+	switch {
+	case length < 126:
+		dst = append(dst, first, maskBit|byte(length))
+	case length <= 0xffff:
+		dst = append(dst, first, maskBit|126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(length))
+	default:
+		dst = append(dst, first, maskBit|127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(length))
+	}
+
+	if mask == nil {
+		return append(dst, f.payload...)
+	}
+	dst = append(dst, mask...)
+	for i, b := range f.payload {
+		dst = append(dst, b^mask[i%4])
+	}
+	return dst
+}
+
+// wsRecorder is a writer which splits one direction of a WebSocket connection into frames.
+// Frames larger than limit are passed truncated to it, the rest of their payload is skipped.
+type wsRecorder struct {
+	buf     []byte
+	limit   int // 0 for no limit
+	skip    uint64
+	onFrame func(wsFrame)
+}
+
+func (r *wsRecorder) Write(p []byte) (int, error) {
+	written := len(p)
+	if r.skip > 0 {
+		n := uint64(len(p))
+		if n > r.skip {
+			n = r.skip
+		}
+		p, r.skip = p[n:], r.skip-n
+	}
+	r.buf = append(r.buf, p...)
+	consumed := 0
+	for {
+		rest := r.buf[consumed:]
+		f, n, length, mask, ok := parseWSHeader(rest)
+		if !ok {
+			break
+		}
+		if size := uint64(n) + length; r.limit > 0 && size > uint64(r.limit) {
+			if len(rest) < r.limit {
+				break
+			}
+			f.payload, f.truncated = unmaskWS(rest[n:r.limit], mask), true
+			r.onFrame(f)
+			if uint64(len(rest)) < size {
+				r.skip = size - uint64(len(rest))
+				consumed = len(r.buf)
+				break
+			}
+			consumed += int(size)
+			continue
+		}
+		if uint64(len(rest)-n) < length {
+			break
+		}
+		f.payload = unmaskWS(rest[n:n+int(length)], mask)
+		consumed += n + int(length)
+		r.onFrame(f)
+	}
+	r.buf = append(r.buf[:0], r.buf[consumed:]...)
+	return written, nil
+}
+
+// frameLimit is the size of buffered frame above which it is recorded truncated, so that the record fits config.BufferSize
+func (i *HTTPInput) frameLimit() int {
+	// header of the recorded frame is at most 10 bytes, control frames have at most 125 bytes of payload and are kept whole
+	if limit := int(i.config.BufferSize) - 10; limit > 256 {
+		return limit
+	}
+	return 256
+}
+
+// recordWebSocketFrame queues frame of the session started by the upgrade request with id session
+func (i *HTTPInput) recordWebSocketFrame(session []byte, dir string, f wsFrame) {
+	extras := []string{MetaField("dir", dir), MetaField("opcode", strconv.Itoa(int(f.opcode)))}
+	if !f.fin {
+		extras = append(extras, MetaField("fin", "0"))
+	}
+	if f.truncated {
+		i.stats.Add("truncated", 1)
+		extras = append(extras, MetaField("truncated", "1"))
+	}
+	i.enqueue(&Message{
+		Meta: PayloadHeader(WebSocketPayload, session, time.Now().UnixNano(), -1, extras...),
+		Data: appendWSFrame(nil, f, nil),
+	})
+}
+
+// serveWebSocket accepts the upgrade of a mirrored request and records client frames until either side closes
+// the connection. Pings are answered and close frames echoed, messages are not answered.
+func (i *HTTPInput) serveWebSocket(w http.ResponseWriter, r *http.Request, session []byte) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	hijacker, ok := w.(http.Hijacker)
+	if key == "" || !ok {
+		// WebSocket over HTTP/2 is not supported
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		Debug(1, fmt.Sprintf("[INPUT-HTTP] WebSocket hijack error: %q", err))
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n")
+	if protocols := r.Header.Get("Sec-WebSocket-Protocol"); protocols != "" {
+		// clients fail the handshake unless one of requested subprotocols is selected
+		rw.WriteString("Sec-WebSocket-Protocol: " + strings.TrimSpace(strings.Split(protocols, ",")[0]) + "\r\n")
+	}
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-i.stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	closed := false
+	recorder := &wsRecorder{limit: i.frameLimit(), onFrame: func(f wsFrame) {
+		i.recordWebSocketFrame(session, "client", f)
+		switch f.opcode {
+		case wsPing:
+			conn.Write(appendWSFrame(nil, wsFrame{fin: true, opcode: wsPong, payload: f.payload}, nil))
+		case wsClose:
+			conn.Write(appendWSFrame(nil, wsFrame{fin: true, opcode: wsClose, payload: f.payload}, nil))
+			closed = true
+		}
+	}}
+	buf := make([]byte, 32*1024)
+	for !closed {
+		n, err := rw.Read(buf)
+		recorder.Write(buf[:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// webSocketTap records frames of a connection upgraded by the reverse proxy:
+// reads return frames of the upstream, writes carry frames of the client
+type webSocketTap struct {
+	io.ReadWriteCloser
+	client, server *wsRecorder
+}
+
+func (i *HTTPInput) tapWebSocket(conn io.ReadWriteCloser, session []byte) *webSocketTap {
+	return &webSocketTap{
+		ReadWriteCloser: conn,
+		client:          &wsRecorder{limit: i.frameLimit(), onFrame: func(f wsFrame) { i.recordWebSocketFrame(session, "client", f) }},
+		server:          &wsRecorder{limit: i.frameLimit(), onFrame: func(f wsFrame) { i.recordWebSocketFrame(session, "server", f) }},
+	}
+}
+
+func (t *webSocketTap) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	t.server.Write(p[:n])
+	return n, err
+}
+
+func (t *webSocketTap) Write(p []byte) (int, error) {
+	t.client.Write(p)
+	return t.ReadWriteCloser.Write(p)
+}
+
+// isWebSocketRequest reports whether recorded request is a WebSocket upgrade
+func isWebSocketRequest(data []byte) bool {
+	return bytes.EqualFold(proto.Header(data, []byte("Upgrade")), []byte("websocket"))
+}
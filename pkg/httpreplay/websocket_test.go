@@ -0,0 +1,296 @@
+package httpreplay
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSFrame(t *testing.T) {
+	for _, length := range []int{0, 125, 126, 70000} {
+		f := wsFrame{fin: length > 0, opcode: wsBinary, payload: bytes.Repeat([]byte{'x'}, length)}
+		for _, mask := range [][]byte{nil, {1, 2, 3, 4}} {
+			data := appendWSFrame(nil, f, mask)
+			if _, _, ok := parseWSFrame(data[:len(data)-1]); ok && len(data) > 2 {
+				t.Errorf("Incomplete frame of %d bytes should not be parsed", length)
+			}
+			parsed, n, ok := parseWSFrame(append(data, 0x81))
+			if !ok || n != len(data) || parsed.fin != f.fin || parsed.opcode != f.opcode || !bytes.Equal(parsed.payload, f.payload) {
+				t.Errorf("Frame of %d bytes with mask %v was not parsed back: %+v", length, mask, parsed)
+			}
+		}
+	}
+}
+
+func TestWSRecorderLimit(t *testing.T) {
+	var frames []wsFrame
+	r := &wsRecorder{limit: 1024, onFrame: func(f wsFrame) { frames = append(frames, f) }}
+
+	// header claims 2^62 bytes of payload
+	huge := []byte{0x82, 127, 0x40, 0, 0, 0, 0, 0, 0, 0}
+	r.Write(huge)
+	chunk := bytes.Repeat([]byte{'x'}, 4096)
+	for i := 0; i < 100; i++ {
+		r.Write(chunk)
+		if len(r.buf) > 1024+len(chunk) {
+			t.Fatalf("Recorder should not buffer more than the limit, got %d bytes", len(r.buf))
+		}
+	}
+	if len(frames) != 1 || !frames[0].truncated || len(frames[0].payload) != 1024-len(huge) {
+		t.Errorf("Expected single truncated frame, got %d", len(frames))
+	}
+
+	// the rest of a large frame is skipped and the next frame is parsed
+	frames = nil
+	r = &wsRecorder{limit: 1024, onFrame: func(f wsFrame) { frames = append(frames, f) }}
+	data := appendWSFrame(nil, wsFrame{fin: true, opcode: wsBinary, payload: bytes.Repeat([]byte{'x'}, 5000)}, []byte{1, 2, 3, 4})
+	data = appendWSFrame(data, wsFrame{fin: true, opcode: wsText, payload: []byte("after")}, []byte{1, 2, 3, 4})
+	for len(data) > 0 {
+		n := 700
+		if n > len(data) {
+			n = len(data)
+		}
+		r.Write(data[:n])
+		data = data[n:]
+	}
+	if len(frames) != 2 || !frames[0].truncated || strings.Trim(string(frames[0].payload), "x") != "" || string(frames[1].payload) != "after" {
+		t.Errorf("Expected truncated frame followed by the next one, got %+v", frames)
+	}
+}
+
+// newWebSocketServer starts server echoing text frames back, every client frame is sent to received
+func newWebSocketServer(t *testing.T, received chan<- wsFrame) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r.Header) {
+			t.Errorf("Expected WebSocket upgrade, got %v", r.Header)
+		}
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		rw.Flush()
+
+		closed := false
+		recorder := &wsRecorder{onFrame: func(f wsFrame) {
+			received <- f
+			if f.opcode == wsText || f.opcode == wsClose {
+				conn.Write(appendWSFrame(nil, f, nil))
+			}
+			closed = f.opcode == wsClose
+		}}
+		buf := make([]byte, 1024)
+		for !closed {
+			n, err := rw.Read(buf)
+			recorder.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}))
+}
+
+// dialTestWebSocket opens WebSocket connection to address and returns reader of the frames
+func dialTestWebSocket(t *testing.T, address string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET /notifications HTTP/1.1\r\nHost: " + address + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected WebSocket handshake, got %s %v", resp.Status, resp.Header)
+	}
+	return conn, reader
+}
+
+// readTestFrame reads a single frame sent by the server
+func readTestFrame(t *testing.T, reader *bufio.Reader) wsFrame {
+	var buf []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, b)
+		if f, _, ok := parseWSFrame(buf); ok {
+			return f
+		}
+	}
+}
+
+func TestWebSocketCapture(t *testing.T) {
+	received := make(chan wsFrame, 10)
+	upstream := newWebSocketServer(t, received)
+	defer upstream.Close()
+
+	mirror := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
+	defer mirror.Close()
+	proxy := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{Upstream: upstream.URL})
+	defer proxy.Close()
+
+	mask := []byte{1, 2, 3, 4}
+	for _, input := range []*HTTPInput{mirror, proxy} {
+		conn, reader := dialTestWebSocket(t, input.address)
+		conn.Write(appendWSFrame(nil, wsFrame{fin: true, opcode: wsText, payload: []byte("hello")}, mask))
+		if input == mirror {
+			conn.Write(appendWSFrame(nil, wsFrame{fin: true, opcode: wsPing, payload: []byte("ping")}, mask))
+			if f := readTestFrame(t, reader); f.opcode != wsPong || string(f.payload) != "ping" {
+				t.Errorf("Expected pong, got %+v", f)
+			}
+		} else if f := readTestFrame(t, reader); string(f.payload) != "hello" {
+			t.Errorf("Expected message echoed by upstream, got %+v", f)
+		}
+		conn.Write(appendWSFrame(nil, wsFrame{fin: true, opcode: wsClose}, mask))
+		if f := readTestFrame(t, reader); f.opcode != wsClose {
+			t.Errorf("Expected close frame to be answered, got %+v", f)
+		}
+		conn.Close()
+	}
+
+	var mirrored []string
+	for len(mirrored) < 4 {
+		msg, _ := mirror.PluginRead()
+		var f wsFrame
+		if IsWebSocketPayload(msg.Meta) {
+			f, _, _ = parseWSFrame(msg.Data)
+		}
+		mirrored = append(mirrored, string(PayloadMeta(msg.Meta)[0])+" "+string(bytes.Join(PayloadMeta(msg.Meta)[4:], []byte(" ")))+" "+string(f.payload))
+	}
+	expected := []string{"1 ip=127.0.0.1 ", "4 dir=client opcode=1 hello", "4 dir=client opcode=9 ping", "4 dir=client opcode=8 "}
+	if strings.Join(mirrored, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected upgrade request followed by client frames:\n%q\n%q", mirrored, expected)
+	}
+
+	session := ""
+	frames := map[string]int{}
+	for i := 0; i < 6; i++ {
+		msg, _ := proxy.PluginRead()
+		if i == 0 {
+			session = string(PayloadID(msg.Meta))
+		} else if string(PayloadID(msg.Meta)) != session {
+			t.Errorf("Expected all records of the session to have the same id: %q", msg.Meta)
+		}
+		if IsWebSocketPayload(msg.Meta) {
+			dir, _ := PayloadMetaField(msg.Meta, "dir")
+			opcode, _ := PayloadMetaField(msg.Meta, "opcode")
+			frames[dir+" "+opcode]++
+		}
+	}
+	if frames["client 1"] != 1 || frames["server 1"] != 1 || frames["client 8"] != 1 || frames["server 8"] != 1 {
+		t.Errorf("Expected frames of both directions to be recorded: %v", frames)
+	}
+}
+
+func TestWebSocketCaptureLargeFrame(t *testing.T) {
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{BufferSize: 1024})
+	defer input.Close()
+	before := expvarInt(input.stats, "truncated")
+
+	conn, _ := dialTestWebSocket(t, input.address)
+	defer conn.Close()
+	conn.Write(appendWSFrame(nil, wsFrame{fin: true, opcode: wsBinary, payload: bytes.Repeat([]byte{'x'}, 5000)}, []byte{1, 2, 3, 4}))
+
+	input.PluginRead()
+	msg, _ := input.PluginRead()
+	if _, truncated := PayloadMetaField(msg.Meta, "truncated"); !truncated || len(msg.Data) > 1024 {
+		t.Errorf("Expected frame to be recorded truncated to the buffer size: %q %d", msg.Meta, len(msg.Data))
+	}
+	if _, _, ok := parseWSFrame(msg.Data); !ok || expvarInt(input.stats, "truncated")-before != 1 {
+		t.Error("Truncated frame should be recorded in wire format and counted")
+	}
+}
+
+func TestWebSocketReplay(t *testing.T) {
+	received := make(chan wsFrame, 10)
+	target := newWebSocketServer(t, received)
+	defer target.Close()
+
+	output := NewHTTPOutput(target.URL, &HTTPOutputConfig{}).(*HTTPOutput)
+	defer output.Close()
+	before := output.Summary()
+
+	session := Uuid()
+	recorded := time.Now().UnixNano()
+	frame := func(offset time.Duration, dir string, f wsFrame) {
+		meta := PayloadHeader(WebSocketPayload, session, recorded+int64(offset), -1, MetaField("dir", dir), MetaField("opcode", "1"))
+		output.PluginWrite(&Message{Meta: meta, Data: appendWSFrame(nil, f, nil)})
+	}
+	output.PluginWrite(&Message{
+		Meta: PayloadHeader(RequestPayload, session, recorded, -1),
+		Data: []byte("GET /notifications HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"),
+	})
+	start := time.Now()
+	frame(0, "client", wsFrame{fin: true, opcode: wsText, payload: []byte("first")})
+	frame(0, "server", wsFrame{fin: true, opcode: wsText, payload: []byte("from server")})
+	frame(200*time.Millisecond, "client", wsFrame{fin: true, opcode: wsText, payload: []byte("second")})
+	frame(200*time.Millisecond, "client", wsFrame{fin: true, opcode: wsClose})
+
+	var payloads []string
+	for len(payloads) < 3 {
+		select {
+		case f := <-received:
+			payloads = append(payloads, string(f.payload))
+			if string(f.payload) == "second" && time.Since(start) < 200*time.Millisecond {
+				t.Error("Frame should be sent at its recorded offset from the upgrade")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Frames were not replayed:", output.Summary())
+		}
+	}
+	if strings.Join(payloads, ",") != "first,second," {
+		t.Errorf("Expected client frames in order, got %q", payloads)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	summary := output.Summary()
+	if summary["websocket_sessions"]-before["websocket_sessions"] != 1 || summary["websocket_frames"]-before["websocket_frames"] != 3 {
+		t.Errorf("Expected session and frames to be counted: %v", summary)
+	}
+}
+
+func TestWebSocketReplaySlowSession(t *testing.T) {
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer target.Close()
+	defer close(release)
+
+	output := NewHTTPOutput(target.URL, &HTTPOutputConfig{QueueLen: 1}).(*HTTPOutput)
+	defer output.Close()
+	before := output.Summary()
+
+	session := Uuid()
+	output.PluginWrite(&Message{
+		Meta: PayloadHeader(RequestPayload, session, 1, -1),
+		Data: []byte("GET /notifications HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"),
+	})
+
+	// the session waits for the upgrade, its queue fits one frame
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < 3; i++ {
+			meta := PayloadHeader(WebSocketPayload, session, 1, -1, MetaField("dir", "client"), MetaField("opcode", "1"))
+			output.PluginWrite(&Message{Meta: meta, Data: appendWSFrame(nil, wsFrame{fin: true, opcode: wsText, payload: []byte("frame")}, nil)})
+		}
+	}()
+	select {
+	case <-written:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Frames of a slow session should not block the output")
+	}
+	if summary := output.Summary(); summary["dropped"]-before["dropped"] != 2 {
+		t.Errorf("Expected frames which don't fit the queue to be dropped: %v", summary)
+	}
+}
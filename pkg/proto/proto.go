@@ -0,0 +1,257 @@
+// Package proto provides functions for reading and modifying raw HTTP payloads in place,
+// without parsing them into http.Request, so the recorded wire format is preserved.
+package proto
+
+import (
+	"bytes"
+)
+
+// MIMEHeadersEndPos returns position of the first body byte, or -1 if the header section is incomplete
+func MIMEHeadersEndPos(payload []byte) int {
+	if pos := bytes.Index(payload, []byte("\r\n\r\n")); pos != -1 {
+		return pos + 4
+	}
+	if pos := bytes.Index(payload, []byte("\n\n")); pos != -1 {
+		return pos + 2
+	}
+	return -1
+}
+
+// MIMEHeadersStartPos returns position of the first header line, right after the request or status line
+func MIMEHeadersStartPos(payload []byte) int {
+	return bytes.IndexByte(payload, '\n') + 1
+}
+
+// HasRequestTitle reports whether payload starts with a request line, e.g. "GET /path HTTP/1.1"
+func HasRequestTitle(payload []byte) bool {
+	line := payload
+	if eol := bytes.IndexByte(payload, '\n'); eol != -1 {
+		line = payload[:eol]
+	}
+	parts := bytes.Split(bytes.TrimRight(line, "\r"), []byte(" "))
+	return len(parts) == 3 && len(parts[0]) > 0 && len(parts[1]) > 0 && bytes.HasPrefix(parts[2], []byte("HTTP/"))
+}
+
+// Method returns method of the request
+func Method(payload []byte) []byte {
+	end := bytes.IndexByte(payload, ' ')
+	if end == -1 {
+		return nil
+	}
+	return payload[:end]
+}
+
+// pathPos returns position of the request URI within request line
+func pathPos(payload []byte) (start, end int) {
+	start = bytes.IndexByte(payload, ' ') + 1
+	if start == 0 {
+		return -1, -1
+	}
+	end = bytes.IndexByte(payload[start:], ' ')
+	if eol := bytes.IndexAny(payload[start:], "\r\n"); end == -1 || (eol != -1 && eol < end) {
+		return -1, -1
+	}
+	return start, start + end
+}
+
+// Path returns request URI, including query string
+func Path(payload []byte) []byte {
+	start, end := pathPos(payload)
+	if start == -1 {
+		return nil
+	}
+	return payload[start:end]
+}
+
+// headerLine holds positions of a single header within payload
+type headerLine struct {
+	start, end           int // whole line including line break
+	valueStart, valueEnd int
+}
+
+// eachHeader calls fn for every header line until it returns false
+func eachHeader(payload []byte, fn func(name []byte, h headerLine) bool) {
+	start := MIMEHeadersStartPos(payload)
+	end := MIMEHeadersEndPos(payload)
+	if end == -1 {
+		end = len(payload)
+	}
+
+	for start > 0 && start < end {
+		var h headerLine
+		h.start = start
+		h.end = end
+		if n := bytes.IndexByte(payload[start:end], '\n'); n != -1 {
+			h.end = start + n + 1
+		}
+
+		line := payload[h.start:h.end]
+		if colon := bytes.IndexByte(line, ':'); colon > 0 {
+			h.valueStart, h.valueEnd = h.start+colon+1, h.end
+			for h.valueStart < h.valueEnd && (payload[h.valueStart] == ' ' || payload[h.valueStart] == '\t') {
+				h.valueStart++
+			}
+			for h.valueEnd > h.valueStart && isSpace(payload[h.valueEnd-1]) {
+				h.valueEnd--
+			}
+			if !fn(line[:colon], h) {
+				return
+			}
+		}
+
+		start = h.end
+	}
+}
+
+// header finds the first header with given case insensitive name, ok is false if there is none
+func header(payload, name []byte) (h headerLine, ok bool) {
+	eachHeader(payload, func(key []byte, line headerLine) bool {
+		if bytes.EqualFold(key, name) {
+			h, ok = line, true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Header returns value of the header, or nil if payload doesn't have it
+func Header(payload, name []byte) []byte {
+	if h, ok := header(payload, name); ok {
+		return payload[h.valueStart:h.valueEnd]
+	}
+	return nil
+}
+
+// Cookie returns value of the cookie sent in Cookie headers, or nil
+func Cookie(payload, name []byte) (value []byte) {
+	eachHeader(payload, func(key []byte, h headerLine) bool {
+		if !bytes.EqualFold(key, []byte("Cookie")) {
+			return true
+		}
+		for _, pair := range bytes.Split(payload[h.valueStart:h.valueEnd], []byte(";")) {
+			pair = bytes.TrimSpace(pair)
+			if eq := bytes.IndexByte(pair, '='); eq > 0 && bytes.Equal(pair[:eq], name) {
+				value = bytes.Trim(pair[eq+1:], `"`)
+				return false
+			}
+		}
+		return true
+	})
+	return
+}
+
+// SetHeader sets value of the first header with given name, or adds the header if payload doesn't have it
+func SetHeader(payload, name, value []byte) []byte {
+	if h, ok := header(payload, name); ok {
+		return replace(payload, h.valueStart, h.valueEnd, value)
+	}
+	return AddHeader(payload, name, value)
+}
+
+// AddHeader inserts header right after the request or status line
+func AddHeader(payload, name, value []byte) []byte {
+	line := make([]byte, 0, len(name)+len(value)+4)
+	line = append(line, name...)
+	line = append(line, ": "...)
+	line = append(line, value...)
+	line = append(line, lineBreak(payload)...)
+	start := MIMEHeadersStartPos(payload)
+	return replace(payload, start, start, line)
+}
+
+// DeleteHeader removes all headers with given case insensitive name
+func DeleteHeader(payload, name []byte) []byte {
+	for {
+		h, ok := header(payload, name)
+		if !ok {
+			return payload
+		}
+		payload = replace(payload, h.start, h.end, nil)
+	}
+}
+
+// SetPath replaces request URI
+func SetPath(payload, path []byte) []byte {
+	start, end := pathPos(payload)
+	if start == -1 {
+		return payload
+	}
+	return replace(payload, start, end, path)
+}
+
+// PathParam returns value of the query parameter and its position within payload, start is -1 if there is none
+func PathParam(payload, name []byte) (value []byte, start, end int) {
+	pathStart, pathEnd := pathPos(payload)
+	if pathStart == -1 {
+		return nil, -1, -1
+	}
+	query := bytes.IndexByte(payload[pathStart:pathEnd], '?')
+	if query == -1 {
+		return nil, -1, -1
+	}
+
+	for pos := pathStart + query + 1; pos < pathEnd; {
+		next := bytes.IndexByte(payload[pos:pathEnd], '&')
+		pairEnd := pathEnd
+		if next != -1 {
+			pairEnd = pos + next
+		}
+		pair := payload[pos:pairEnd]
+		if eq := bytes.IndexByte(pair, '='); eq != -1 && bytes.Equal(pair[:eq], name) {
+			return pair[eq+1:], pos + eq + 1, pairEnd
+		} else if eq == -1 && bytes.Equal(pair, name) {
+			return pair[len(pair):], pairEnd, pairEnd
+		}
+		pos = pairEnd + 1
+	}
+	return nil, -1, -1
+}
+
+// SetPathParam sets value of the query parameter, or appends the parameter if request URI doesn't have it
+func SetPathParam(payload, name, value []byte) []byte {
+	if _, start, end := PathParam(payload, name); start != -1 {
+		// parameter without value, e.g. "?debug"
+		if payload[start-1] != '=' {
+			value = append([]byte("="), value...)
+		}
+		return replace(payload, start, end, value)
+	}
+
+	path := Path(payload)
+	if path == nil {
+		return payload
+	}
+	param := make([]byte, 0, len(name)+len(value)+2)
+	if bytes.IndexByte(path, '?') == -1 {
+		param = append(param, '?')
+	} else if !bytes.HasSuffix(path, []byte("?")) && !bytes.HasSuffix(path, []byte("&")) {
+		param = append(param, '&')
+	}
+	param = append(param, name...)
+	param = append(param, '=')
+	param = append(param, value...)
+
+	_, end := pathPos(payload)
+	return replace(payload, end, end, param)
+}
+
+// replace returns copy of payload with bytes between start and end replaced by value
+func replace(payload []byte, start, end int, value []byte) []byte {
+	result := make([]byte, 0, len(payload)-(end-start)+len(value))
+	result = append(result, payload[:start]...)
+	result = append(result, value...)
+	return append(result, payload[end:]...)
+}
+
+// lineBreak returns line separator used by payload
+func lineBreak(payload []byte) []byte {
+	if eol := bytes.IndexByte(payload, '\n'); eol > 0 && payload[eol-1] != '\r' {
+		return []byte("\n")
+	}
+	return []byte("\r\n")
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
@@ -0,0 +1,106 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	payload := []byte("POST /post HTTP/1.1\r\nContent-Length: 7\r\nhost:  www.w3.org \r\nX-Empty:\r\n\r\na=1&b=2")
+
+	tests := []struct {
+		name, value string
+	}{
+		{"Content-Length", "7"},
+		{"Host", "www.w3.org"},
+		{"X-Empty", ""},
+		{"a=1&b=2", ""},
+	}
+	for _, tt := range tests {
+		if value := Header(payload, []byte(tt.name)); string(value) != tt.value {
+			t.Errorf("Expected %s to be %q, got %q", tt.name, tt.value, value)
+		}
+	}
+	if Header(payload, []byte("Missing")) != nil {
+		t.Error("Expected missing header to be nil")
+	}
+}
+
+func TestCookie(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\nCookie: a=1; session=\"abc\"\nCookie: b=2\n\n")
+
+	if v := Cookie(payload, []byte("session")); !bytes.Equal(v, []byte("abc")) {
+		t.Errorf("Expected session cookie, got %q", v)
+	}
+	if v := Cookie(payload, []byte("b")); !bytes.Equal(v, []byte("2")) {
+		t.Errorf("Expected cookie from second header, got %q", v)
+	}
+	if v := Cookie(payload, []byte("c")); v != nil {
+		t.Errorf("Expected no cookie, got %q", v)
+	}
+}
+
+func TestRequestLine(t *testing.T) {
+	payload := []byte("POST /post?a=1 HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+
+	if !HasRequestTitle(payload) || HasRequestTitle([]byte("HTTP/1.1 200 OK\r\n\r\n")) {
+		t.Error("Expected only request to have request line")
+	}
+	if m := Method(payload); string(m) != "POST" {
+		t.Errorf("Expected POST, got %q", m)
+	}
+	if p := Path(payload); string(p) != "/post?a=1" {
+		t.Errorf("Expected /post?a=1, got %q", p)
+	}
+	if p := Path([]byte("GET /\r\n\r\n")); p != nil {
+		t.Errorf("Expected no path in malformed request, got %q", p)
+	}
+}
+
+func TestSetHeader(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\nX-Key: 1\r\nx-key: 2\r\n\r\nbody")
+
+	tests := []struct {
+		payload, expected []byte
+	}{
+		{SetHeader(payload, []byte("host"), []byte("staging")), []byte("GET / HTTP/1.1\r\nHost: staging\r\nX-Key: 1\r\nx-key: 2\r\n\r\nbody")},
+		{SetHeader(payload, []byte("User-Agent"), []byte("Gor")), []byte("GET / HTTP/1.1\r\nUser-Agent: Gor\r\nHost: www.w3.org\r\nX-Key: 1\r\nx-key: 2\r\n\r\nbody")},
+		{DeleteHeader(payload, []byte("X-Key")), []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\nbody")},
+		{AddHeader([]byte("GET / HTTP/1.1\n\n"), []byte("A"), []byte("1")), []byte("GET / HTTP/1.1\nA: 1\n\n")},
+	}
+	for _, tt := range tests {
+		if !bytes.Equal(tt.payload, tt.expected) {
+			t.Errorf("Expected %q, got %q", tt.expected, tt.payload)
+		}
+	}
+	if !bytes.Equal(payload, []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\nX-Key: 1\r\nx-key: 2\r\n\r\nbody")) {
+		t.Error("Original payload should not be modified")
+	}
+}
+
+func TestSetPathParam(t *testing.T) {
+	tests := []struct {
+		path, name, value, expected string
+	}{
+		{"/", "a", "1", "/?a=1"},
+		{"/?b=2", "a", "1", "/?b=2&a=1"},
+		{"/?a=2&b=3", "a", "1", "/?a=1&b=3"},
+		{"/?b=3&a=", "a", "1", "/?b=3&a=1"},
+		{"/?debug&b=3", "debug", "1", "/?debug=1&b=3"},
+		{"/?ab=2", "a", "1", "/?ab=2&a=1"},
+	}
+	for _, tt := range tests {
+		payload := []byte("GET " + tt.path + " HTTP/1.1\r\n\r\n")
+		if p := Path(SetPathParam(payload, []byte(tt.name), []byte(tt.value))); string(p) != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, p)
+		}
+	}
+
+	payload := []byte("GET /?a=1&b=2 HTTP/1.1\r\n\r\n")
+	if v, _, _ := PathParam(payload, []byte("b")); string(v) != "2" {
+		t.Errorf("Expected b to be 2, got %q", v)
+	}
+	if p := Path(SetPath(payload, []byte("/v2"))); string(p) != "/v2" {
+		t.Errorf("Expected /v2, got %q", p)
+	}
+}